@@ -1,5 +1,11 @@
 package arc
 
+import (
+	"errors"
+	"geecache/simplelru"
+	"sync"
+)
+
 // ARCCache 是一个线程安全的固定大小自适应替换缓存(ARC)。
 // ARC是对标准LRU缓存的一个增强，它可以同时跟踪这两个缓存
 // 使用的频率和频率。这避免了访问新内容的突然爆发
@@ -8,3 +14,326 @@ package arc
 // 大约是开销的2倍，额外的内存开销是线性的
 // 使用缓存的大小。ARC已经被IBM申请了专利，但它是
 // 类似于TwoQueueCache (2Q)，需要设置参数。
+type ARCCache struct {
+	size int // 缓存的总条数
+	p    int // T1的目标大小，根据B1、B2的命中情况自适应调整
+
+	t1 simplelru.LRUCache // T1 最近只访问过一次的条目
+	b1 simplelru.LRUCache // B1 从T1淘汰的条目，只保留key(幽灵列表)
+
+	t2 simplelru.LRUCache // T2 最近访问过多次的条目
+	b2 simplelru.LRUCache // B2 从T2淘汰的条目，只保留key(幽灵列表)
+
+	onEvict simplelru.EvictCallback
+	moving  bool // 正在把条目从T1提升到T2，此时的移除不算淘汰
+	lock    sync.RWMutex
+}
+
+// 编译期检查ARCCache实现了LRUCache接口
+var _ simplelru.LRUCache = (*ARCCache)(nil)
+
+// NewARC 构造一个给定大小的ARC
+func NewARC(size int) (*ARCCache, error) {
+	return NewARCWithEvict(size, nil)
+}
+
+// NewARCWithEvict 构造一个给定大小的ARC
+// 和simplelru一样，常驻条目(T1、T2)因淘汰、过期或Remove离开缓存时都会回调onEvict
+func NewARCWithEvict(size int, onEvict simplelru.EvictCallback) (*ARCCache, error) {
+	if size <= 0 {
+		return nil, errors.New("must provide a positive size")
+	}
+	c := &ARCCache{
+		size:    size,
+		p:       0,
+		onEvict: onEvict,
+	}
+	// 幽灵列表只保存key，不需要回调
+	b1, err := simplelru.NewLRU(size, nil)
+	if err != nil {
+		return nil, err
+	}
+	b2, err := simplelru.NewLRU(size, nil)
+	if err != nil {
+		return nil, err
+	}
+	t1, err := simplelru.NewLRU(size, c.evicted)
+	if err != nil {
+		return nil, err
+	}
+	t2, err := simplelru.NewLRU(size, c.evicted)
+	if err != nil {
+		return nil, err
+	}
+	c.t1, c.b1, c.t2, c.b2 = t1, b1, t2, b2
+	return c, nil
+}
+
+// Add 向缓存添加一个值。如果已经存在,则更新信息
+func (c *ARCCache) Add(key, value interface{}, expirationTime int64) (ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// 在T1中，说明第二次访问，提升到T2
+	if c.t1.Contains(key) {
+		c.promote(key, value, expirationTime)
+		return true
+	}
+
+	// 已经在T2中，直接更新
+	if c.t2.Contains(key) {
+		c.t2.Add(key, value, expirationTime)
+		return true
+	}
+
+	// 命中B1，说明T1太小，增大p
+	if c.b1.Contains(key) {
+		delta := 1
+		b1Len := c.b1.Len()
+		b2Len := c.b2.Len()
+		if b2Len > b1Len {
+			delta = b2Len / b1Len
+		}
+		// p不超过实际的条数，按字节数淘汰时size远大于实际的条数
+		if limit := min(c.size, c.t1.Len()+c.t2.Len()); c.p+delta >= limit {
+			c.p = limit
+		} else {
+			c.p += delta
+		}
+
+		// 缓存满了，腾出空间
+		if c.t1.Len()+c.t2.Len() >= c.size {
+			c.replace(false)
+		}
+
+		// 从B1移除，加入T2
+		c.b1.Remove(key)
+		c.t2.Add(key, value, expirationTime)
+		return true
+	}
+
+	// 命中B2，说明T2太小，减小p
+	if c.b2.Contains(key) {
+		delta := 1
+		b1Len := c.b1.Len()
+		b2Len := c.b2.Len()
+		if b1Len > b2Len {
+			delta = b1Len / b2Len
+		}
+		if delta >= c.p {
+			c.p = 0
+		} else {
+			c.p -= delta
+		}
+
+		// 缓存满了，腾出空间
+		if c.t1.Len()+c.t2.Len() >= c.size {
+			c.replace(true)
+		}
+
+		// 从B2移除，加入T2
+		c.b2.Remove(key)
+		c.t2.Add(key, value, expirationTime)
+		return true
+	}
+
+	// 全新的key，缓存满了要腾出空间
+	if c.t1.Len()+c.t2.Len() >= c.size {
+		c.replace(false)
+	}
+
+	// 控制幽灵列表的大小
+	if c.b1.Len() > c.size-c.p {
+		c.b1.RemoveOldest()
+	}
+	if c.b2.Len() > c.p {
+		c.b2.RemoveOldest()
+	}
+
+	// 加入T1
+	c.t1.Add(key, value, expirationTime)
+	return true
+}
+
+// replace 根据p自适应地从T1或T2淘汰一个条目，key留在对应的幽灵列表中
+// 应该淘汰的列表为空时从另一个列表淘汰，返回淘汰的条目
+func (c *ARCCache) replace(b2ContainsKey bool) (key interface{}, value interface{}, expirationTime int64, ok bool) {
+	t1Len := c.t1.Len()
+	fromT1 := t1Len > 0 && (t1Len > c.p || (t1Len == c.p && b2ContainsKey))
+	if !fromT1 && c.t2.Len() == 0 {
+		fromT1 = t1Len > 0
+	}
+	if fromT1 {
+		if key, value, expirationTime, ok = c.t1.RemoveOldest(); ok {
+			c.b1.Add(key, nil, 0)
+		}
+	} else if key, value, expirationTime, ok = c.t2.RemoveOldest(); ok {
+		c.b2.Add(key, nil, 0)
+	}
+	c.trimGhosts()
+	return key, value, expirationTime, ok
+}
+
+// trimGhosts 幽灵列表的总条数不超过常驻条目的条数
+// 外部按字节数淘汰时size远大于实际的条数，只按size限制的话幽灵列表会无限增长
+// 和ARC一样，T1和B1加起来超过常驻条数时裁剪B1，否则裁剪B2
+func (c *ARCCache) trimGhosts() {
+	live := c.t1.Len() + c.t2.Len()
+	for c.b1.Len()+c.b2.Len() > live {
+		if c.b2.Len() == 0 || (c.b1.Len() > 0 && c.t1.Len()+c.b1.Len() > live) {
+			c.b1.RemoveOldest()
+		} else {
+			c.b2.RemoveOldest()
+		}
+	}
+}
+
+// promote 把T1中的条目移到T2
+func (c *ARCCache) promote(key, value interface{}, expirationTime int64) {
+	c.moving = true
+	c.t1.Remove(key)
+	c.moving = false
+	c.t2.Add(key, value, expirationTime)
+}
+
+// evicted T1、T2的移除回调，提升时的移除不转发给onEvict
+func (c *ARCCache) evicted(key, value interface{}, expirationTime int64) {
+	if c.onEvict != nil && !c.moving {
+		c.onEvict(key, value, expirationTime)
+	}
+}
+
+// Get 从缓存中查找一个键的值。
+func (c *ARCCache) Get(key interface{}) (value interface{}, expirationTime int64, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// 在T1中，提升到T2
+	if value, expirationTime, ok = c.t1.Peek(key); ok && value != nil {
+		c.promote(key, value, expirationTime)
+		return value, expirationTime, ok
+	}
+
+	// 在T2中，Get会更新T2中的顺序
+	if value, expirationTime, ok = c.t2.Get(key); ok {
+		return value, expirationTime, ok
+	}
+	return nil, 0, false
+}
+
+// Contains 检查某个键是否在缓存中，但不更新缓存的状态
+func (c *ARCCache) Contains(key interface{}) (ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.t1.Contains(key) || c.t2.Contains(key)
+}
+
+// Peek 在不更新的情况下返回键值(如果没有找到则返回false),不更新缓存的状态
+func (c *ARCCache) Peek(key interface{}) (value interface{}, expirationTime int64, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if value, expirationTime, ok = c.t1.Peek(key); ok && value != nil {
+		return value, expirationTime, ok
+	}
+	if value, expirationTime, ok = c.t2.Peek(key); ok && value != nil {
+		return value, expirationTime, ok
+	}
+	return nil, 0, false
+}
+
+// Remove 从缓存中移除提供的键，幽灵列表中的记录也一并移除
+func (c *ARCCache) Remove(key interface{}) (ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.t1.Remove(key) {
+		return true
+	}
+	if c.t2.Remove(key) {
+		return true
+	}
+	c.b1.Remove(key)
+	c.b2.Remove(key)
+	return false
+}
+
+// RemoveOldest 按ARC的规则淘汰一个条目，根据p决定淘汰T1还是T2
+// 外部按字节数淘汰时调用它，p的自适应调整同样生效
+func (c *ARCCache) RemoveOldest() (key interface{}, value interface{}, expirationTime int64, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.replace(false)
+}
+
+// GetOldest 从缓存中返回最旧的条目，优先返回T1中的
+func (c *ARCCache) GetOldest() (key interface{}, value interface{}, expirationTime int64, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if key, value, expirationTime, ok = c.t1.GetOldest(); ok {
+		return key, value, expirationTime, ok
+	}
+	return c.t2.GetOldest()
+}
+
+// Keys 返回缓存中键的切片，先T1后T2，各自从最老到最新
+func (c *ARCCache) Keys() []interface{} {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	k1 := c.t1.Keys()
+	k2 := c.t2.Keys()
+	return append(k1, k2...)
+}
+
+// Len 获取缓存已存在的缓存条数
+func (c *ARCCache) Len() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.t1.Len() + c.t2.Len()
+}
+
+// Purge 清除所有缓存项
+func (c *ARCCache) Purge() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.t1.Purge()
+	c.t2.Purge()
+	c.b1.Purge()
+	c.b2.Purge()
+	c.p = 0
+}
+
+// PurgeOverdue 清除所有过期缓存项。
+func (c *ARCCache) PurgeOverdue() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.t1.PurgeOverdue()
+	c.t2.PurgeOverdue()
+}
+
+// Resize 调整缓存大小，返回被淘汰的条数
+func (c *ARCCache) Resize(size int) (evicted int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if size <= 0 {
+		size = 1
+	}
+	// 先按ARC的规则淘汰到新大小，再调整四个列表
+	// RemoveOldest会顺带清掉过期的条目，按长度的变化计数，没有变化时停止
+	for n := c.t1.Len() + c.t2.Len(); n > size; {
+		c.replace(false)
+		m := c.t1.Len() + c.t2.Len()
+		if m == n {
+			break
+		}
+		evicted += n - m
+		n = m
+	}
+	c.size = size
+	if c.p > size {
+		c.p = size
+	}
+	c.t1.Resize(size)
+	c.t2.Resize(size)
+	c.b1.Resize(size)
+	c.b2.Resize(size)
+	return evicted
+}
@@ -0,0 +1,298 @@
+package arc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestARC(t *testing.T) {
+	initTime := initTime()
+
+	evictCounter := 0
+	onEvicted := func(k interface{}, v interface{}, expirationTime int64) {
+		if k != v {
+			t.Fatalf("Evict values not equal (%v!=%v) , time = %v", k, v, expirationTime)
+		}
+		evictCounter++
+	}
+	l, err := NewARCWithEvict(128, onEvicted)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for i := 0; i < 256; i++ {
+		l.Add(i, i, initTime)
+	}
+	if l.Len() != 128 {
+		t.Fatalf("bad len: %v", l.Len())
+	}
+	if evictCounter != 128 {
+		t.Fatalf("bad evict count: %v", evictCounter)
+	}
+
+	for i, k := range l.Keys() {
+		if v, expirationTime, ok := l.Get(k); !ok || v != k || v != i+128 {
+			t.Fatalf("bad key: %v, time: %v", k, expirationTime)
+		}
+	}
+	for i := 0; i < 128; i++ {
+		if _, expirationTime, ok := l.Get(i); ok {
+			t.Fatalf("should be evicted , time: %v", expirationTime)
+		}
+	}
+	for i := 128; i < 256; i++ {
+		if _, expirationTime, ok := l.Get(i); !ok {
+			t.Fatalf("should not be evicted, time: %v", expirationTime)
+		}
+	}
+	for i := 128; i < 192; i++ {
+		if ok := l.Remove(i); !ok {
+			t.Fatalf("should be contained")
+		}
+		if ok := l.Remove(i); ok {
+			t.Fatalf("should not be contained")
+		}
+		if _, expirationTime, ok := l.Get(i); ok {
+			t.Fatalf("should be deleted, time: %v", expirationTime)
+		}
+	}
+
+	l.Purge()
+	if l.Len() != 0 {
+		t.Fatalf("bad len: %v", l.Len())
+	}
+	if _, expirationTime, ok := l.Get(200); ok {
+		t.Fatalf("should contain nothing, time: %v", expirationTime)
+	}
+}
+
+// 第二次访问的条目进入T2，新条目的突发不会把它挤出去
+func TestARC_ScanResistant(t *testing.T) {
+	initTime := initTime()
+
+	l, err := NewARC(4)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// 热点key访问两次，进入T2
+	l.Add("hot", "hot", initTime)
+	l.Get("hot")
+	if n := l.t2.Len(); n != 1 {
+		t.Fatalf("bad t2 len: %v", n)
+	}
+
+	// 一批只访问一次的key
+	for i := 0; i < 16; i++ {
+		l.Add(i, i, initTime)
+	}
+	if !l.Contains("hot") {
+		t.Fatalf("hot key should survive the scan")
+	}
+	if l.Len() != 4 {
+		t.Fatalf("bad len: %v", l.Len())
+	}
+}
+
+// 命中幽灵列表B1会增大p，并直接进入T2
+func TestARC_Adaptive(t *testing.T) {
+	initTime := initTime()
+
+	l, err := NewARC(4)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		l.Add(i, i, initTime)
+	}
+	if !l.b1.Contains(0) {
+		t.Fatalf("0 should be in b1")
+	}
+	if l.p != 0 {
+		t.Fatalf("bad p: %v", l.p)
+	}
+
+	l.Add(0, 0, initTime)
+	if l.p != 1 {
+		t.Fatalf("bad p: %v", l.p)
+	}
+	if l.b1.Contains(0) || !l.t2.Contains(0) {
+		t.Fatalf("0 should be moved from b1 to t2")
+	}
+}
+
+// Test that Contains doesn't update recent-ness
+func TestARC_Contains(t *testing.T) {
+	initTime := initTime()
+
+	l, err := NewARC(2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	l.Add(1, 1, initTime)
+	l.Add(2, 2, initTime)
+	if !l.Contains(1) {
+		t.Errorf("1 should be contained")
+	}
+
+	l.Add(3, 3, initTime)
+	if l.Contains(1) {
+		t.Errorf("Contains should not have updated recent-ness of 1")
+	}
+}
+
+// Test that Peek doesn't update recent-ness
+func TestARC_Peek(t *testing.T) {
+	initTime := initTime()
+
+	l, err := NewARC(2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	l.Add(1, 1, initTime)
+	l.Add(2, 2, initTime)
+	if v, _, ok := l.Peek(1); !ok || v != 1 {
+		t.Errorf("1 should be set to 1: %v, %v", v, ok)
+	}
+
+	l.Add(3, 3, initTime)
+	if l.Contains(1) {
+		t.Errorf("should not have updated recent-ness of 1")
+	}
+}
+
+// Test that Resize can upsize and downsize
+func TestARC_Resize(t *testing.T) {
+	initTime := initTime()
+
+	onEvictCounter := 0
+	onEvicted := func(k interface{}, v interface{}, expirationTime int64) {
+		onEvictCounter++
+	}
+	l, err := NewARCWithEvict(2, onEvicted)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Downsize
+	l.Add(1, 1, initTime)
+	l.Add(2, 2, initTime)
+	evicted := l.Resize(1)
+	if evicted != 1 {
+		t.Errorf("1 element should have been evicted: %v", evicted)
+	}
+	if onEvictCounter != 1 {
+		t.Errorf("onEvicted should have been called 1 time: %v", onEvictCounter)
+	}
+
+	l.Add(3, 3, initTime)
+	if l.Contains(1) {
+		t.Errorf("Element 1 should have been evicted")
+	}
+
+	// Upsize
+	evicted = l.Resize(2)
+	if evicted != 0 {
+		t.Errorf("0 elements should have been evicted: %v", evicted)
+	}
+
+	l.Add(4, 4, initTime)
+	if !l.Contains(3) || !l.Contains(4) {
+		t.Errorf("Cache should have contained 2 elements")
+	}
+}
+
+// p等于size并且T2为空时，淘汰要退回到T1，不能空转
+func TestARC_ReplaceEmptyT2(t *testing.T) {
+	initTime := initTime()
+
+	l, err := NewARC(4)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		l.Add(i, i, initTime)
+	}
+	if !l.b1.Contains(0) || l.t2.Len() != 0 {
+		t.Fatalf("0 should be in b1")
+	}
+	// 命中B1后p等于size，T2为空，要从T1淘汰，总数不能超过size
+	l.p = 3
+	l.Add(0, 0, initTime)
+	if l.p != 4 || l.Len() != 4 || !l.t2.Contains(0) || !l.b1.Contains(1) {
+		t.Fatalf("bad p %v, len %v", l.p, l.Len())
+	}
+
+	// T1有3个、T2为空、p为3时缩小
+	l, _ = NewARC(4)
+	for i := 0; i < 3; i++ {
+		l.Add(i, i, initTime)
+	}
+	l.p = 3
+	done := make(chan int)
+	go func() { done <- l.Resize(2) }()
+	select {
+	case evicted := <-done:
+		if evicted != 1 || l.Len() != 2 || !l.b1.Contains(0) {
+			t.Fatalf("bad evicted %v, len %v", evicted, l.Len())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Resize should not loop forever")
+	}
+}
+
+func TestARC_PurgeOverdue(t *testing.T) {
+	l, err := NewARC(4)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// 已经过期的时间点
+	overdue := time.Now().UnixNano()/1e6 - 1000
+	l.Add(1, 1, overdue)
+	l.Add(2, 2, initTime())
+	l.PurgeOverdue()
+	if l.Len() != 1 || !l.Contains(2) {
+		t.Fatalf("only 2 should be left, len: %v", l.Len())
+	}
+	if _, _, ok := l.Get(1); ok {
+		t.Fatalf("1 should be expired")
+	}
+}
+
+// 生成当前时间
+func initTime() int64 {
+	return time.Now().UnixNano()/1e6 + 2000
+}
+
+// 外部按字节数淘汰：size远大于实际条数，靠RemoveOldest淘汰
+// 幽灵列表不能超过常驻条数，淘汰按p选择T1或T2
+func TestARC_RemoveOldest(t *testing.T) {
+	l, _ := NewARC(1 << 20)
+	for i := 0; i < 100; i++ {
+		l.Add(i, i, 0)
+	}
+	for i := 100; i < 10000; i++ {
+		l.Add(i, i, 0)
+		if _, _, _, ok := l.RemoveOldest(); !ok {
+			t.Fatal("should evict")
+		}
+	}
+	if n := l.Len(); n != 100 {
+		t.Fatalf("bad len: %d", n)
+	}
+	if n := l.b1.Len() + l.b2.Len(); n > 100 {
+		t.Fatalf("ghost lists should be bounded by live entries, got %d", n)
+	}
+
+	// T1没有超过p时淘汰T2
+	l.Get(9999)
+	l.p = l.t1.Len()
+	k, _, _, ok := l.RemoveOldest()
+	if !ok || k != 9999 || !l.b2.Contains(9999) {
+		t.Fatalf("should evict from T2 when T1 is within p, got %v", k)
+	}
+}
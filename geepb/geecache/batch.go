@@ -0,0 +1,194 @@
+package geecache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// GetMany 批量获取多个key
+// 缓存没有命中的key按负责的节点分组，每个远程节点只发一次BatchGet请求，
+// 自己负责的key通过singleflight并发加载。返回值和每个key的错误
+func (g *Group) GetMany(ctx context.Context, keys []string) (map[string]ByteView, map[string]error) {
+	b := &batch{
+		values: make(map[string]ByteView, len(keys)),
+		errs:   make(map[string]error),
+	}
+
+	// 先查本地缓存，剩下的按节点分组，不支持批量获取的节点逐个获取
+	var local, single []string
+	remote := make(map[BatchFetcher][]string)
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if key == "" {
+			b.setErr(key, fmt.Errorf("key is required"))
+			continue
+		}
+		g.stats.gets.Add(1)
+		if v, ok := g.lookupCache(key); ok {
+			b.set(key, v)
+			continue
+		}
+		if err, ok := g.lookupNegative(key); ok {
+			b.setErr(key, err)
+			continue
+		}
+		if err := g.rejectByBloom(key); err != nil {
+			b.setErr(key, err)
+			continue
+		}
+		if g.server != nil {
+			if peer, ok := g.server.Pick(key); ok {
+				if bf, ok := peer.(BatchFetcher); ok {
+					remote[bf] = append(remote[bf], key)
+				} else {
+					single = append(single, key)
+				}
+				continue
+			}
+		}
+		local = append(local, key)
+	}
+
+	var wg sync.WaitGroup
+	for peer, peerKeys := range remote {
+		wg.Add(1)
+		go func(peer BatchFetcher, keys []string) {
+			defer wg.Done()
+			g.batchFromPeer(ctx, b, peer, keys)
+		}(peer, peerKeys)
+	}
+	loadEach := func(keys []string, load func(ctx context.Context, key string) (ByteView, error)) {
+		for _, key := range keys {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				value, err := load(ctx, key)
+				if err != nil {
+					if stale, ok := g.staleOnError(ctx, key, err); ok {
+						value, err = stale, nil
+					}
+				}
+				b.result(key, value, err)
+			}(key)
+		}
+	}
+	loadEach(local, g.loadLocally)
+	loadEach(single, g.load)
+	wg.Wait()
+	return b.values, b.errs
+}
+
+// 从一个远程节点批量获取，整个请求失败时和load一样回退到本地加载
+func (g *Group) batchFromPeer(ctx context.Context, b *batch, peer BatchFetcher, keys []string) {
+	values, errs, err := peer.BatchFetch(ctx, g.name, keys)
+	if err != nil {
+		g.stats.peerErrors.Add(1)
+		if ctx.Err() != nil {
+			for _, key := range keys {
+				b.setErr(key, ctx.Err())
+			}
+			return
+		}
+		if g.fetchPolicy.FailFast {
+			for _, key := range keys {
+				b.setErr(key, err)
+			}
+			return
+		}
+		g.logger.Warn("batch get from peer failed, loading locally", "group", g.name, "keys", len(keys), "err", err)
+		var wg sync.WaitGroup
+		for _, key := range keys {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				value, err := g.loadLocally(ctx, key)
+				b.result(key, value, err)
+			}(key)
+		}
+		wg.Wait()
+		return
+	}
+	for _, key := range keys {
+		if entry, ok := values[key]; ok {
+			g.stats.peerLoads.Add(1)
+			g.learnKey(key)
+			value := ByteView{b: cloneBytes(entry.Value), version: entry.Version, expire: entry.Expire}
+			g.populateHotCache(key, value, entry.Expire)
+			b.set(key, value)
+		} else if e, ok := errs[key]; ok {
+			// 和load一样，负责的节点确认不存在时记到负缓存
+			if classifyFetchError(e) == kindNotFound {
+				g.negCache.add(key, e)
+			}
+			b.setErr(key, e)
+		} else {
+			b.setErr(key, fmt.Errorf("peer returned no value for %s", key))
+		}
+	}
+}
+
+// getFromLocal 只查本地缓存和Getter，不访问远程节点
+func (g *Group) getFromLocal(ctx context.Context, key string) (ByteView, error) {
+	if v, ok := g.lookupCache(key); ok {
+		return v, nil
+	}
+	if err, ok := g.lookupNegative(key); ok {
+		return ByteView{}, err
+	}
+	if err := g.rejectByBloom(key); err != nil {
+		return ByteView{}, err
+	}
+	v, err := g.loadLocally(ctx, key)
+	if err != nil {
+		if stale, ok := g.staleOnError(ctx, key, err); ok {
+			return stale, nil
+		}
+	}
+	return v, err
+}
+
+// 通过singleflight从本地加载
+func (g *Group) loadLocally(ctx context.Context, key string) (ByteView, error) {
+	g.stats.loads.Add(1)
+	view, err := g.loader.DoContext(ctx, key, func(ctx context.Context) (interface{}, error) {
+		g.stats.loadsDeduped.Add(1)
+		return g.getLocally(ctx, key)
+	})
+	if err != nil {
+		return ByteView{}, err
+	}
+	return view.(ByteView), nil
+}
+
+// batch 并发写入的批量结果
+type batch struct {
+	mu     sync.Mutex
+	values map[string]ByteView
+	errs   map[string]error
+}
+
+func (b *batch) set(key string, value ByteView) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.values[key] = value
+}
+
+func (b *batch) setErr(key string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.errs[key] = err
+}
+
+// result 把一次加载的结果写入batch
+func (b *batch) result(key string, value ByteView, err error) {
+	if err != nil {
+		b.setErr(key, err)
+		return
+	}
+	b.set(key, value)
+}
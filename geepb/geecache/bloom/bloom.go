@@ -0,0 +1,174 @@
+package bloom
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"sync/atomic"
+)
+
+// Filter 线程安全的布隆过滤器，Test返回false时key一定不存在，返回true时可能存在
+// 位数组用原子操作读写，Add和Test可以并发调用
+type Filter struct {
+	m    uint64 // 位数，64的倍数
+	k    uint32 // 哈希函数个数
+	bits []atomic.Uint64
+	// 添加过的key的个数，重复添加也会计数，只用于估计误判率
+	count atomic.Uint64
+}
+
+// 快照文件的魔数和版本
+const (
+	magic   = "GEEBLOOM"
+	version = 1
+)
+
+// New 按预计的key数量n和误判率fp创建一个过滤器
+func New(n uint64, fp float64) *Filter {
+	if n == 0 {
+		n = 1
+	}
+	if fp <= 0 || fp >= 1 {
+		fp = 0.01
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(fp) / (math.Ln2 * math.Ln2)))
+	k := uint32(math.Round(float64(m) / float64(n) * math.Ln2))
+	return NewWithSize(m, k)
+}
+
+// NewWithSize 指定位数m和哈希函数个数k创建一个过滤器，m向上取到64的倍数
+func NewWithSize(m uint64, k uint32) *Filter {
+	if m == 0 {
+		m = 1
+	}
+	if k == 0 {
+		k = 1
+	}
+	words := (m + 63) / 64
+	return &Filter{m: words * 64, k: k, bits: make([]atomic.Uint64, words)}
+}
+
+// FromKeys 用一批key创建一个过滤器，用于启动或者重建时一次性加载所有存在的key
+func FromKeys(keys []string, fp float64) *Filter {
+	f := New(uint64(len(keys)), fp)
+	for _, key := range keys {
+		f.Add(key)
+	}
+	return f
+}
+
+// Empty 创建一个大小和f一样的空过滤器，用于重建
+func (f *Filter) Empty() *Filter {
+	return NewWithSize(f.m, f.k)
+}
+
+// 两个哈希值组合出k个位置(Kirsch-Mitzenmacher)
+// 快照会在不同进程间加载，不能用每个进程随机种子的哈希
+func (f *Filter) hashes(key string) (h1, h2 uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h1 = h.Sum64()
+	// splitmix64的混合函数，从h1得到第二个哈希
+	h2 = h1 + 0x9e3779b97f4a7c15
+	h2 = (h2 ^ (h2 >> 30)) * 0xbf58476d1ce4e5b9
+	h2 = (h2 ^ (h2 >> 27)) * 0x94d049bb133111eb
+	h2 ^= h2 >> 31
+	return h1, h2 | 1
+}
+
+// Add 添加一个key
+func (f *Filter) Add(key string) {
+	h1, h2 := f.hashes(key)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		pos := (h1 + i*h2) % f.m
+		f.bits[pos/64].Or(1 << (pos % 64))
+	}
+	f.count.Add(1)
+}
+
+// Test 判断key是否可能存在
+func (f *Filter) Test(key string) bool {
+	h1, h2 := f.hashes(key)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		pos := (h1 + i*h2) % f.m
+		if f.bits[pos/64].Load()&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Count 添加过的key的个数
+func (f *Filter) Count() uint64 {
+	return f.count.Load()
+}
+
+// Cap 位数和哈希函数个数
+func (f *Filter) Cap() (m uint64, k uint32) {
+	return f.m, f.k
+}
+
+// WriteTo 把过滤器写成快照，格式为魔数、版本、m、k、count和位数组，整数都是小端
+// 写的同时有Add时，快照包含其中一部分key
+func (f *Filter) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	var n int64
+	write := func(b []byte) error {
+		nn, err := bw.Write(b)
+		n += int64(nn)
+		return err
+	}
+	header := make([]byte, 0, len(magic)+1+8+4+8)
+	header = append(header, magic...)
+	header = append(header, version)
+	header = binary.LittleEndian.AppendUint64(header, f.m)
+	header = binary.LittleEndian.AppendUint32(header, f.k)
+	header = binary.LittleEndian.AppendUint64(header, f.count.Load())
+	if err := write(header); err != nil {
+		return n, err
+	}
+	var word [8]byte
+	for i := range f.bits {
+		binary.LittleEndian.PutUint64(word[:], f.bits[i].Load())
+		if err := write(word[:]); err != nil {
+			return n, err
+		}
+	}
+	return n, bw.Flush()
+}
+
+// ReadFrom 从WriteTo写的快照加载一个过滤器
+func ReadFrom(r io.Reader) (*Filter, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(magic)+1+8+4+8)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("read bloom filter header: %w", err)
+	}
+	if string(header[:len(magic)]) != magic {
+		return nil, errors.New("not a bloom filter snapshot")
+	}
+	b := header[len(magic):]
+	if b[0] != version {
+		return nil, fmt.Errorf("unsupported bloom filter snapshot version %d", b[0])
+	}
+	m := binary.LittleEndian.Uint64(b[1:])
+	k := binary.LittleEndian.Uint32(b[9:])
+	count := binary.LittleEndian.Uint64(b[13:])
+	if m == 0 || m%64 != 0 || k == 0 {
+		return nil, fmt.Errorf("bad bloom filter size m=%d k=%d", m, k)
+	}
+	f := NewWithSize(m, k)
+	f.count.Store(count)
+	var word [8]byte
+	for i := range f.bits {
+		if _, err := io.ReadFull(br, word[:]); err != nil {
+			return nil, fmt.Errorf("read bloom filter bits: %w", err)
+		}
+		f.bits[i].Store(binary.LittleEndian.Uint64(word[:]))
+	}
+	return f, nil
+}
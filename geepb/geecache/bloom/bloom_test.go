@@ -0,0 +1,77 @@
+package bloom
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	f := New(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		f.Add(strconv.Itoa(i))
+	}
+	for i := 0; i < 1000; i++ {
+		if !f.Test(strconv.Itoa(i)) {
+			t.Fatalf("%d should be in the filter", i)
+		}
+	}
+	// 误判率应该在1%附近
+	fp := 0
+	for i := 1000; i < 11000; i++ {
+		if f.Test(strconv.Itoa(i)) {
+			fp++
+		}
+	}
+	if fp > 200 {
+		t.Fatalf("too many false positives: %d/10000", fp)
+	}
+	if f.Count() != 1000 {
+		t.Fatalf("bad count %d", f.Count())
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	f := FromKeys([]string{"Tom", "Jack", "Sam"}, 0.01)
+	var buf bytes.Buffer
+	n, err := f.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Fatalf("wrote %d bytes, returned %d", buf.Len(), n)
+	}
+
+	g, err := ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gm, gk := g.Cap(); gm != f.m || gk != f.k || g.Count() != 3 {
+		t.Fatalf("bad filter m=%d k=%d count=%d", gm, gk, g.Count())
+	}
+	for _, key := range []string{"Tom", "Jack", "Sam"} {
+		if !g.Test(key) {
+			t.Fatalf("%s should be in the loaded filter", key)
+		}
+	}
+
+	if _, err := ReadFrom(bytes.NewReader([]byte("not a snapshot at all, really"))); err == nil {
+		t.Fatal("should reject a bad snapshot")
+	}
+	buf.Reset()
+	f.WriteTo(&buf)
+	if _, err := ReadFrom(bytes.NewReader(buf.Bytes()[:buf.Len()-1])); err == nil {
+		t.Fatal("should reject a truncated snapshot")
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	f := FromKeys([]string{"Tom"}, 0.01)
+	e := f.Empty()
+	if e.Test("Tom") || e.Count() != 0 {
+		t.Fatal("empty filter should contain nothing")
+	}
+	if em, ek := e.Cap(); em != f.m || ek != f.k {
+		t.Fatalf("bad size m=%d k=%d", em, ek)
+	}
+}
@@ -0,0 +1,173 @@
+package geecache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// 熔断器的默认配置
+const (
+	defaultBreakerFailures    = 5
+	defaultBreakerOpenTimeout = 10 * time.Second
+)
+
+// ErrBreakerOpen 远程节点的熔断器打开，请求没有发出
+var ErrBreakerOpen = errors.New("geecache: peer circuit breaker is open")
+
+// BreakerState 熔断器的状态
+type BreakerState int
+
+const (
+	// BreakerClosed 正常状态，请求都发给远程节点
+	BreakerClosed BreakerState = iota
+	// BreakerOpen 连续失败太多次，一段时间内不再请求这个节点
+	BreakerOpen
+	// BreakerHalfOpen 打开一段时间后，放一个探测请求过去，成功就关闭，失败就重新打开
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// BreakerConfig 每个远程节点的熔断器配置，零值字段使用默认值
+type BreakerConfig struct {
+	// Failures 连续失败多少次后打开，默认5次
+	// 只有节点不可用、超时这类错误算失败，key不存在、Getter出错说明节点是好的
+	Failures int
+	// OpenTimeout 打开多久后进入半开状态，默认10秒
+	OpenTimeout time.Duration
+	// Disabled 为true时不使用熔断器
+	Disabled bool
+}
+
+// PeerStats 一个远程节点的状态
+type PeerStats struct {
+	Addr     string
+	Breaker  BreakerState
+	Failures int   // 连续失败的次数
+	Opens    int64 // 熔断器打开的次数
+}
+
+// breaker 一个远程节点的熔断器，nil表示不使用
+type breaker struct {
+	failures    int
+	openTimeout time.Duration
+
+	mu          sync.Mutex
+	state       BreakerState
+	consecutive int       // 连续失败的次数
+	openedAt    time.Time // 打开的时间
+	probing     bool      // 半开状态下探测请求还没有返回
+	opens       int64
+}
+
+func newBreaker(cfg BreakerConfig) *breaker {
+	if cfg.Disabled {
+		return nil
+	}
+	b := &breaker{failures: cfg.Failures, openTimeout: cfg.OpenTimeout}
+	if b.failures <= 0 {
+		b.failures = defaultBreakerFailures
+	}
+	if b.openTimeout <= 0 {
+		b.openTimeout = defaultBreakerOpenTimeout
+	}
+	return b
+}
+
+// ready 现在能不能向这个节点发请求，不改变状态，Pick时用
+func (b *breaker) ready() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		return time.Since(b.openedAt) >= b.openTimeout
+	case BreakerHalfOpen:
+		return !b.probing
+	default:
+		return true
+	}
+}
+
+// allow 发请求前调用，不能发时返回ErrBreakerOpen
+// 打开超时后进入半开状态，只放一个探测请求过去
+func (b *breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.openTimeout {
+			return ErrBreakerOpen
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+	case BreakerHalfOpen:
+		if b.probing {
+			return ErrBreakerOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// record 请求返回后记录结果，ctx是调用方传入的ctx，不是加了默认超时的
+// 成功或者节点给出了回答(比如key不存在)时关闭，节点不可用、超时算一次失败
+func (b *breaker) record(ctx context.Context, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	kind := classifyFetchError(err)
+	// 调用方取消的请求(比如对冲请求先返回后取消的那个)、调用方自己设的超时到了，
+	// 都不能说明节点好坏，状态不变
+	if err != nil && (kind == kindCanceled || ctx.Err() != nil) {
+		return
+	}
+	if err == nil || kind != kindRetryable {
+		b.state = BreakerClosed
+		b.consecutive = 0
+		return
+	}
+	b.consecutive++
+	if b.state == BreakerHalfOpen || b.consecutive >= b.failures {
+		if b.state != BreakerOpen {
+			b.opens++
+		}
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// stats 熔断器的状态，打开超时但还没有请求时也算半开
+func (b *breaker) stats() (state BreakerState, failures int, opens int64) {
+	if b == nil {
+		return BreakerClosed, 0, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state = b.state
+	if state == BreakerOpen && time.Since(b.openedAt) >= b.openTimeout {
+		state = BreakerHalfOpen
+	}
+	return state, b.consecutive, b.opens
+}
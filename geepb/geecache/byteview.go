@@ -1,11 +1,20 @@
 package geecache
 
+import "time"
+
 type ByteView struct {
 	//存储缓存值，byte可以存储任意类型的数据
 	b []byte
+	//值的版本，加入缓存时计算，0表示还没有计算
+	version uint64
+	//不为nil时b是用它压缩过的，只在缓存内部出现，取出时已经解压
+	codec Codec
+	//过期的时间点，从缓存取出或者加载时设置，返回给远程节点，零值表示不过期
+	expire time.Time
 }
 
 // 缓存ByteView对象必须有len方法
+// 缓存内部压缩存储的值返回压缩后的长度，用于计算缓存占用的字节数
 func (v ByteView) Len() int {
 	return len(v.b)
 }
@@ -18,6 +27,14 @@ func (v ByteView) String() string {
 	return string(v.b)
 }
 
+// Version 值的版本，取内容的哈希，值不变时版本不变
+func (v ByteView) Version() uint64 {
+	if v.version != 0 {
+		return v.version
+	}
+	return valueVersion(v.b)
+}
+
 func cloneBytes(b []byte) []byte {
 	c := make([]byte, len(b))
 	copy(c, b)
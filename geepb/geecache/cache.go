@@ -1,7 +1,6 @@
 package geecache
 
 import (
-	"geecache/lru"
 	"sync"
 	"time"
 )
@@ -11,47 +10,165 @@ const defaultExpiration = 1 * time.Minute
 type cache struct {
 	//锁
 	mu sync.Mutex
-	//lru包外访问lru类型，要大写
-	lru *lru.Lru
-	//lru *highperformance.HashLruCache
+	//淘汰策略创建的存储，第一次add时才创建
+	store Store
+	//淘汰策略，为nil时使用LRU
+	policy Policy
 	//缓存池大小
 	cacheBytes int64
+	//过期后在存储中继续保留的时间，这段时间内的旧值只在加载失败时使用
+	grace time.Duration
+	//压缩算法，不小于compressThreshold字节的值压缩后存储，为nil时不压缩
+	codec             Codec
+	compressThreshold int
+	//查询次数、命中次数和淘汰次数
+	nget, nhit, nevict int64
+	//正在添加或删除的key，它离开缓存不算淘汰
+	updating string
+}
+
+// CacheStats 一个缓存的统计信息
+type CacheStats struct {
+	Bytes int64 // 占用的字节数
+	Items int64 // 条数
+	Gets  int64 // 查询次数
+	Hits  int64 // 命中次数
+	// 淘汰的条数，包括过期被清除的，不包括覆盖和删除
+	Evictions int64
 }
 
 func (c *cache) add(key string, value ByteView, expiration ...time.Duration) {
+	// 版本在加入缓存时算一次，之后每次返回给远程节点时不用再算
+	// 压缩比较慢，在加锁之前完成，codec创建Group后不再改变
+	value.version = value.Version()
+	value = compress(c.codec, c.compressThreshold, value)
 	c.mu.Lock()
 	//defer表示add函数结束后，无论是正常结束还是错误结束，都解锁，defer的解锁是压栈方式的解锁，先入后解锁
 	defer c.mu.Unlock()
-	if c.lru == nil {
-		c.lru = lru.New(c.cacheBytes, nil)
-		//c.lru, _ = highperformance.NewHashLRU(5, 5)
-
+	if c.store == nil {
+		policy := c.policy
+		if policy == nil {
+			policy = LRU
+		}
+		c.store = policy.NewStore(c.cacheBytes, c.onEvicted)
 	}
+	c.updating = key
+	defer func() { c.updating = "" }()
 	var exp time.Duration
 	if len(expiration) > 0 {
 		exp = expiration[0]
 	} else {
 		exp = defaultExpiration
 	}
-	c.lru.Add(key, value, exp)
-	//c.lru.Add(key, value, exp.Nanoseconds())
+	if exp > 0 {
+		exp += c.grace
+	}
+	c.store.Add(key, value, exp)
 }
 
 func (c *cache) get(key string) (v ByteView, ok bool) {
+	v, _, ok = c.getWithExpire(key)
+	return
+}
+
+// getWithExpire 查找没有过期的值，同时返回过期的时间点，不过期或者Store不支持时为零值
+// 压缩的值在释放锁之后解压
+func (c *cache) getWithExpire(key string) (v ByteView, expire time.Time, ok bool) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.lru == nil {
+	c.nget++
+	v, expire, ok = c.lookup(key)
+	if !ok || c.stale(expire) {
+		c.mu.Unlock()
+		return ByteView{}, time.Time{}, false
+	}
+	c.nhit++
+	c.mu.Unlock()
+	if v, ok = c.decompress(key, v); !ok {
+		return ByteView{}, time.Time{}, false
+	}
+	v.expire = expire
+	return
+}
+
+// getStale 查找已经过期、还在保留期内的旧值，不计入统计
+func (c *cache) getStale(key string) (v ByteView, ok bool) {
+	c.mu.Lock()
+	v, expire, ok := c.lookup(key)
+	c.mu.Unlock()
+	if !ok || !c.stale(expire) {
+		return ByteView{}, false
+	}
+	if v, ok = c.decompress(key, v); ok {
+		v.expire = expire
+	}
+	return v, ok
+}
+
+// decompress 解压失败说明数据损坏，删除这个条目，当作没有命中
+func (c *cache) decompress(key string, v ByteView) (ByteView, bool) {
+	d, err := decompress(v)
+	if err != nil {
+		c.remove(key)
+		return ByteView{}, false
+	}
+	return d, true
+}
+
+// 调用时已经持有锁，返回的过期时间已经扣除了保留期
+func (c *cache) lookup(key string) (v ByteView, expire time.Time, ok bool) {
+	if c.store == nil {
 		return
+	}
+	if s, isExpire := c.store.(ExpireStore); isExpire {
+		v, expire, ok = s.GetWithExpire(key)
 	} else {
-		v, ok := c.lru.Get(key)
-		if ok {
-			return v.(ByteView), ok
-		}
-		//v, t, ok := c.lru.Get(key)
-		//log.Println(t)
-		//if ok {
-		//return v.(ByteView), ok
-		//}
+		v, ok = c.store.Get(key)
+	}
+	if ok && !expire.IsZero() {
+		expire = expire.Add(-c.grace)
 	}
 	return
 }
+
+// 过了过期时间，但还在保留期内
+func (c *cache) stale(expire time.Time) bool {
+	return c.grace > 0 && !expire.IsZero() && time.Now().After(expire)
+}
+
+func (c *cache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.store == nil {
+		return
+	}
+	c.updating = key
+	c.store.Remove(key)
+	c.updating = ""
+}
+
+// purgeOverdue 清除过期的条目，过了保留期的才清除
+func (c *cache) purgeOverdue() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.store.(OverdueStore); ok {
+		s.PurgeOverdue()
+	}
+}
+
+// 条目离开缓存时的回调，调用时已经持有锁
+func (c *cache) onEvicted(key string, value ByteView) {
+	if key != c.updating {
+		c.nevict++
+	}
+}
+
+func (c *cache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := CacheStats{Gets: c.nget, Hits: c.nhit, Evictions: c.nevict}
+	if c.store != nil {
+		s.Bytes = c.store.Bytes()
+		s.Items = int64(c.store.Len())
+	}
+	return s
+}
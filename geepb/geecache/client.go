@@ -2,78 +2,223 @@ package geecache
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	pb "geecache/geecachepb"
 	"geecache/registry"
-	clientv3 "go.etcd.io/etcd/client/v3"
 	"google.golang.org/grpc"
-	"log"
-	"sync"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"time"
 )
 
+// ctx没有设置超时时，一次远程调用的默认超时时间
+const defaultFetchTimeout = 10 * time.Second
+
 // client 模块实现gocache访问其他远程节点得客户端 从而获取缓存的能力
+// 连接由ConnManager管理，同一个节点的client共用一个连接
 type client struct {
-	name       string // 服务名称 geecache/ip:addr
-	etcdClient *clientv3.Client
-	conn       *grpc.ClientConn
-	mu         sync.Mutex
+	name    string // 服务名称 geecache/ip:addr
+	addr    string // 远程节点地址，用于监控指标和连接管理
+	metrics *metrics
+	logger  Logger
+	conns   *ConnManager
+	breaker *breaker // 熔断器，为nil时不熔断
+	// 每次调用附带的gRPC选项，比如压缩
+	callOpts []grpc.CallOption
+	// NewClient创建的client自己持有连接管理器和etcd客户端的引用，Close时释放
+	// server创建的client共用server的连接，为nil
+	etcd *registry.EtcdDiscovery
 }
 
-// 初始化客户端，与etcd服务端连接
-func (c *client) initialize() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	//clientv3.NewCtxClient()
-	//创建etcd客户端
-	if c.etcdClient == nil {
-		var err error
-		c.etcdClient, err = clientv3.New(defaultEtcdConfig)
-		if err != nil {
-			return fmt.Errorf("failed to create etcd client: %v", err)
-		}
+// 实现fetch接口，
+func (c *client) Fetch(ctx context.Context, group string, key string) ([]byte, error) {
+	entry, err := c.FetchEntry(ctx, group, key)
+	return entry.Value, err
+}
+
+// FetchEntry 获取值，同时返回负责节点上的过期时间和版本
+func (c *client) FetchEntry(ctx context.Context, group string, key string) (Entry, error) {
+	return c.get(ctx, group, key, func(ctx context.Context, stub pb.GroupCacheClient) (*pb.Response, error) {
+		//发送一个gPRC请求到远程服务，请求包括组名和键名，
+		return stub.Get(ctx, &pb.Request{Group: group, Key: key, LocalOnly: isLocalOnly(ctx)}, c.callOpts...)
+	})
+}
+
+// FetchIfChanged 带着持有的版本获取，版本没有变化时远程节点不返回值，Entry.NotModified为true
+func (c *client) FetchIfChanged(ctx context.Context, group string, key string, version uint64) (Entry, error) {
+	return c.get(ctx, group, key, func(ctx context.Context, stub pb.GroupCacheClient) (*pb.Response, error) {
+		return stub.GetIfChanged(ctx, &pb.ConditionalRequest{Group: group, Key: key, Version: version}, c.callOpts...)
+	})
+}
+
+// get Fetch和FetchIfChanged共用的熔断、超时和错误处理
+func (c *client) get(ctx context.Context, group string, key string,
+	call func(ctx context.Context, stub pb.GroupCacheClient) (*pb.Response, error)) (Entry, error) {
+	if err := c.breaker.allow(); err != nil {
+		return Entry{}, fmt.Errorf("could not get %s/%s from peer %s: %w", group, key, c.name, err)
 	}
-	// 客户端根据服务名返回一个rpc连接
-	if c.conn == nil {
-		conn, err := registry.EtcdDial(c.etcdClient, c.name)
-		if err != nil {
-			return fmt.Errorf("failed to dial gRPC server: %v", err)
+	// 取得到远程节点的gRPC客户端，第一次使用时建立连接
+	grpcClient, err := c.conns.stub(c.addr, c.name)
+	if err != nil {
+		c.breaker.record(ctx, err)
+		c.logger.Error("client initialization failed", "peer", c.name, "err", err)
+		return Entry{}, err
+	}
+	callCtx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+	resp, err := call(callCtx, grpcClient)
+	c.breaker.record(ctx, err)
+	if err != nil {
+		// 负责的节点确认不存在，不算节点出错
+		if status.Code(err) == codes.NotFound {
+			return Entry{}, fmt.Errorf("%w: %s/%s on peer %s", ErrNotFound, group, key, c.name)
 		}
-		c.conn = conn
+		c.logger.Warn("gRPC call failed", "peer", c.name, "group", group, "key", key, "err", err)
+		c.fetchFailed()
+		return Entry{}, fmt.Errorf("could not get %s/%s from peer %s: %w", group, key, c.name, err)
 	}
+	c.logger.Debug("fetched from peer", "peer", c.name, "group", group, "key", key)
+	return Entry{
+		Value:       resp.GetValue(),
+		Expire:      millisToExpire(resp.GetExpire()),
+		Version:     resp.GetVersion(),
+		NotModified: resp.GetNotModified(),
+	}, nil
+}
 
+// Set 在远程节点写入一个值
+func (c *client) Set(ctx context.Context, group string, key string, value []byte, ttl time.Duration) error {
+	if err := c.breaker.allow(); err != nil {
+		return fmt.Errorf("could not set %s/%s to peer %s: %w", group, key, c.name, err)
+	}
+	grpcClient, err := c.conns.stub(c.addr, c.name)
+	if err != nil {
+		c.breaker.record(ctx, err)
+		return err
+	}
+	callCtx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+	_, err = grpcClient.Set(callCtx, &pb.SetRequest{
+		Group: group,
+		Key:   key,
+		Value: value,
+		Ttl:   ttlToMillis(ttl),
+	}, c.callOpts...)
+	c.breaker.record(ctx, err)
+	if err != nil {
+		return fmt.Errorf("could not set %s/%s to peer %s: %w", group, key, c.name, err)
+	}
 	return nil
 }
 
-// 实现fetch接口，
-func (c *client) Fetch(group string, key string) ([]byte, error) {
-	// 初始化
-	if err := c.initialize(); err != nil {
-		log.Printf("Initialization failed: %v", err)
-		return nil, err
+// Delete 在远程节点删除一个值
+func (c *client) Delete(ctx context.Context, group string, key string, localOnly bool) error {
+	if err := c.breaker.allow(); err != nil {
+		return fmt.Errorf("could not delete %s/%s from peer %s: %w", group, key, c.name, err)
 	}
-	log.Println("Initialization successful")
+	grpcClient, err := c.conns.stub(c.addr, c.name)
+	if err != nil {
+		c.breaker.record(ctx, err)
+		return err
+	}
+	callCtx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+	_, err = grpcClient.Delete(callCtx, &pb.DeleteRequest{
+		Group:     group,
+		Key:       key,
+		LocalOnly: localOnly,
+	}, c.callOpts...)
+	c.breaker.record(ctx, err)
+	if err != nil {
+		return fmt.Errorf("could not delete %s/%s from peer %s: %w", group, key, c.name, err)
+	}
+	return nil
+}
 
-	//如果连接成功，会使用这个grpc得连接创建一个新的gRPC客户端
-	grpcClient := pb.NewGroupCacheClient(c.conn)
-	if grpcClient == nil {
-		log.Println("Failed to create gRPC client")
-		return nil, fmt.Errorf("failed to create gRPC client")
+// BatchFetch 一次请求从远程节点获取多个key
+func (c *client) BatchFetch(ctx context.Context, group string, keys []string) (map[string]Entry, map[string]error, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, nil, fmt.Errorf("could not batch get %d keys of %s from peer %s: %w", len(keys), group, c.name, err)
+	}
+	grpcClient, err := c.conns.stub(c.addr, c.name)
+	if err != nil {
+		c.breaker.record(ctx, err)
+		return nil, nil, err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	callCtx, cancel := withDefaultTimeout(ctx)
 	defer cancel()
-	//发送一个gPRC请求到远程服务，请求包括组名和键名，
-	resp, err := grpcClient.Get(ctx, &pb.Request{Group: group, Key: key})
+	resp, err := grpcClient.BatchGet(callCtx, &pb.BatchRequest{Group: group, Keys: keys}, c.callOpts...)
+	c.breaker.record(ctx, err)
 	if err != nil {
-		log.Printf("gRPC call failed: %v", err)
-		return nil, fmt.Errorf("could not get %s/%s from peer %s: %v", group, key, c.name, err)
+		c.fetchFailed()
+		return nil, nil, fmt.Errorf("could not batch get %d keys of %s from peer %s: %w", len(keys), group, c.name, err)
 	}
-	log.Println("Successfully sent gRPC request")
-	return resp.GetValue(), nil
+	errs := make(map[string]error, len(resp.GetErrors()))
+	for key, msg := range resp.GetErrors() {
+		errs[key] = errors.New(msg)
+	}
+	// 负责的节点确认不存在的key，和Fetch一样可以用errors.Is匹配ErrNotFound
+	for _, key := range resp.GetNotFound() {
+		errs[key] = fmt.Errorf("%w: %s/%s on peer %s", ErrNotFound, group, key, c.name)
+	}
+	values := make(map[string]Entry, len(resp.GetValues()))
+	for key, value := range resp.GetValues() {
+		values[key] = Entry{
+			Value:   value,
+			Expire:  millisToExpire(resp.GetExpires()[key]),
+			Version: resp.GetVersions()[key],
+		}
+	}
+	return values, errs, nil
+}
+
+// 记录一次获取失败
+func (c *client) fetchFailed() {
+	if c.metrics != nil {
+		c.metrics.peerError(c.addr)
+	}
+}
+
+// 调用方没有设置超时，使用默认超时
+func withDefaultTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, defaultFetchTimeout)
 }
 
 // 用于创建新的client实例，接收一个服务名作为参数，这个服务名是etcd中注册的服务名，用于在 Fetch 方法中与远程服务通信。
-func NewClient(service string) *client {
+// config 是etcd注册中心的配置，不传时使用默认配置，相同配置的client共用一个etcd客户端
+func NewClient(service string, config ...RegistryConfig) *client {
+	var cfg RegistryConfig
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+	etcd := registry.SharedEtcd(cfg)
 	// x.x.x.x:port
-	return &client{name: service}
+	return &client{
+		name:   service,
+		addr:   service,
+		logger: nopLogger{},
+		conns:  NewConnManager(etcd),
+		etcd:   etcd,
+	}
+}
+
+// Close 关闭NewClient创建的连接，释放etcd客户端的引用
+// server创建的client共用server的连接，由server关闭，这里什么都不做
+func (c *client) Close() error {
+	if c.etcd == nil {
+		return nil
+	}
+	var errs []error
+	if err := c.conns.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.etcd.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("close etcd: %v", err))
+	}
+	c.etcd = nil
+	return errors.Join(errs...)
 }
@@ -0,0 +1,100 @@
+package geecache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	// 注册gRPC的gzip压缩，节点之间可以用WithRPCCompression("gzip")压缩请求和响应
+	_ "google.golang.org/grpc/encoding/gzip"
+)
+
+// Codec 缓存值的压缩算法，snappy、zstd等实现这个接口就可以用WithCompression开启
+// 实现需要是线程安全的
+type Codec interface {
+	// Name 算法的名字，用于日志
+	Name() string
+	Encode(src []byte) ([]byte, error)
+	Decode(src []byte) ([]byte, error)
+}
+
+// Gzip 标准库gzip实现的Codec，默认压缩级别
+var Gzip Codec = newGzipCodec(gzip.DefaultCompression)
+
+// NewGzipCodec 指定压缩级别的gzip，级别和compress/gzip的一样，不合法时返回错误
+func NewGzipCodec(level int) (Codec, error) {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid gzip compression level %d", level)
+	}
+	return newGzipCodec(level), nil
+}
+
+// newGzipCodec 级别已经检查过，gzip.NewWriterLevel不会失败
+func newGzipCodec(level int) *gzipCodec {
+	c := &gzipCodec{level: level}
+	c.writers.New = func() interface{} {
+		w, _ := gzip.NewWriterLevel(io.Discard, level)
+		return w
+	}
+	return c
+}
+
+type gzipCodec struct {
+	level int
+	// 复用gzip.Writer，它的内部缓冲比较大
+	writers sync.Pool
+}
+
+func (c *gzipCodec) Name() string {
+	return "gzip"
+}
+
+func (c *gzipCodec) Encode(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := c.writers.Get().(*gzip.Writer)
+	defer c.writers.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *gzipCodec) Decode(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// compress 值不小于阈值并且压缩后变小时返回压缩的ByteView，否则原样返回
+// 版本按压缩前的内容计算
+func compress(codec Codec, threshold int, value ByteView) ByteView {
+	if codec == nil || value.codec != nil || value.Len() < threshold {
+		return value
+	}
+	b, err := codec.Encode(value.b)
+	if err != nil || len(b) >= value.Len() {
+		return value
+	}
+	return ByteView{b: b, version: value.Version(), codec: codec}
+}
+
+// decompress 解压ByteView，没有压缩时原样返回
+func decompress(value ByteView) (ByteView, error) {
+	if value.codec == nil {
+		return value, nil
+	}
+	b, err := value.codec.Decode(value.b)
+	if err != nil {
+		return ByteView{}, err
+	}
+	return ByteView{b: b, version: value.version}, nil
+}
@@ -0,0 +1,90 @@
+package geecache
+
+import (
+	"errors"
+	"fmt"
+	pb "geecache/geecachepb"
+	"geecache/registry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"sync"
+)
+
+// ConnManager 按节点地址管理到其他节点的gRPC连接，同一个节点只建立一个连接
+// 所有client、所有缓存池共用连接和生成的stub
+// 可以用WithConnManager让同一个进程里的多个server共用
+type ConnManager struct {
+	// 能按服务名建立连接的服务发现(例如etcd)，为nil时直接连接节点地址
+	dialer registry.Dialer
+
+	mu    sync.Mutex
+	peers map[string]*peerConn // 节点地址 -> 连接
+}
+
+// 到一个节点的连接和stub
+type peerConn struct {
+	conn *grpc.ClientConn
+	stub pb.GroupCacheClient
+}
+
+// NewConnManager 创建连接管理器
+// d实现了registry.Dialer时通过它按服务名建立连接，否则直接连接节点地址，d可以为nil
+func NewConnManager(d Discovery) *ConnManager {
+	m := &ConnManager{peers: make(map[string]*peerConn)}
+	if dialer, ok := d.(registry.Dialer); ok {
+		m.dialer = dialer
+	}
+	return m
+}
+
+// stub 返回到节点addr的stub，第一次使用时建立连接，service是节点在服务发现中的服务名
+func (m *ConnManager) stub(addr, service string) (pb.GroupCacheClient, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if pc, ok := m.peers[addr]; ok {
+		return pc.stub, nil
+	}
+	var conn *grpc.ClientConn
+	var err error
+	if m.dialer != nil {
+		conn, err = m.dialer.Dial(service)
+	} else {
+		conn, err = grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial gRPC server %s: %v", addr, err)
+	}
+	m.peers[addr] = &peerConn{conn: conn, stub: pb.NewGroupCacheClient(conn)}
+	return m.peers[addr].stub, nil
+}
+
+// Remove 关闭到节点addr的连接，节点离开哈希环时调用
+// 之后再访问这个节点会重新建立连接
+func (m *ConnManager) Remove(addr string) error {
+	m.mu.Lock()
+	pc, ok := m.peers[addr]
+	delete(m.peers, addr)
+	m.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	if err := pc.conn.Close(); err != nil {
+		return fmt.Errorf("close connection to %s: %v", addr, err)
+	}
+	return nil
+}
+
+// Close 关闭所有连接
+func (m *ConnManager) Close() error {
+	m.mu.Lock()
+	peers := m.peers
+	m.peers = make(map[string]*peerConn)
+	m.mu.Unlock()
+	var errs []error
+	for addr, pc := range peers {
+		if err := pc.conn.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close connection to %s: %v", addr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,183 @@
+package geecache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrNotFound key不存在，Getter可以返回它(或者包装它的错误)
+// 负责的节点返回这个错误时，其他节点不再重试，也不回退到本地加载
+var ErrNotFound = errors.New("geecache: key not found")
+
+// FetchPolicy 从远程节点获取的策略，零值表示不重试、不对冲、失败时回退到本地加载
+type FetchPolicy struct {
+	// Retries 可重试的错误(节点不可用、超时等)最多重试几次
+	Retries int
+	// Backoff 第一次重试前等待的时间，之后每次翻倍，不超过MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// HedgeAfter 大于0时，请求超过这个时间没有返回，就向哈希环上的下一个节点发一个同样的请求
+	// 下一个节点自己加载，不再转发，两个请求谁先成功用谁的结果
+	HedgeAfter time.Duration
+	// FailFast 为true时从远程节点获取失败直接返回错误，不回退到本地加载
+	FailFast bool
+}
+
+// SuccessorPicker 可选接口，返回key在哈希环上的下一个节点
+// Picker实现了它才能发对冲请求，下一个节点是自己时ok为false
+type SuccessorPicker interface {
+	Successor(key string) (peer Fetcher, ok bool)
+}
+
+// 远程获取错误的分类，根据gRPC状态码判断
+type fetchErrorKind int
+
+const (
+	kindFailed    fetchErrorKind = iota // 远程节点出错，可以回退到本地加载
+	kindRetryable                       // 节点暂时不可用或超时，可以重试
+	kindNotFound                        // 负责的节点确认key不存在
+	kindCanceled                        // 请求被取消
+)
+
+func classifyFetchError(err error) fetchErrorKind {
+	if errors.Is(err, ErrNotFound) {
+		return kindNotFound
+	}
+	if errors.Is(err, context.Canceled) {
+		return kindCanceled
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return kindRetryable
+	}
+	switch status.Code(err) {
+	case codes.NotFound:
+		return kindNotFound
+	case codes.Canceled:
+		return kindCanceled
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return kindRetryable
+	default:
+		return kindFailed
+	}
+}
+
+// fetchFromPeer 按策略从远程节点获取，可重试的错误按退避时间重试
+// version不为0时按版本获取，负责节点上的版本一样时返回的Entry.NotModified为true
+func (g *Group) fetchFromPeer(ctx context.Context, peer Fetcher, key string, version uint64) (Entry, error) {
+	p := g.fetchPolicy
+	backoff := p.Backoff
+	for attempt := 0; ; attempt++ {
+		entry, err := g.hedgedFetch(ctx, peer, key, version)
+		if err == nil {
+			return entry, nil
+		}
+		if attempt >= p.Retries || classifyFetchError(err) != kindRetryable || ctx.Err() != nil {
+			return Entry{}, err
+		}
+		g.stats.peerRetries.Add(1)
+		g.logger.Debug("retry fetching from peer", "group", g.name, "key", key, "attempt", attempt+1, "err", err)
+		if backoff > 0 {
+			select {
+			case <-ctx.Done():
+				return Entry{}, ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+				backoff = p.MaxBackoff
+			}
+		}
+	}
+}
+
+type fetchResult struct {
+	entry Entry
+	err   error
+}
+
+// hedgedFetch 请求负责的节点，超过HedgeAfter没有返回时再请求下一个节点
+// 返回先成功的结果，都失败时返回负责节点的错误
+func (g *Group) hedgedFetch(ctx context.Context, peer Fetcher, key string, version uint64) (Entry, error) {
+	if g.fetchPolicy.HedgeAfter <= 0 {
+		return g.fetchOnce(ctx, peer, key, version)
+	}
+	sp, ok := g.server.(SuccessorPicker)
+	if !ok {
+		return g.fetchOnce(ctx, peer, key, version)
+	}
+
+	// 先返回的请求成功后取消另一个
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	primary := make(chan fetchResult, 1)
+	go func() {
+		entry, err := g.fetchOnce(ctx, peer, key, version)
+		primary <- fetchResult{entry, err}
+	}()
+
+	timer := time.NewTimer(g.fetchPolicy.HedgeAfter)
+	defer timer.Stop()
+	select {
+	case r := <-primary:
+		return r.entry, r.err
+	case <-timer.C:
+	}
+	successor, ok := sp.Successor(key)
+	if !ok {
+		r := <-primary
+		return r.entry, r.err
+	}
+	g.stats.peerHedges.Add(1)
+	g.logger.Debug("hedge fetch to successor", "group", g.name, "key", key)
+	hedged := make(chan fetchResult, 1)
+	go func() {
+		entry, err := fetchEntry(withLocalOnly(ctx), successor, g.name, key)
+		hedged <- fetchResult{entry, err}
+	}()
+
+	var first, second fetchResult
+	select {
+	case first = <-primary:
+		if first.err == nil {
+			return first.entry, nil
+		}
+		second = <-hedged
+	case second = <-hedged:
+		if second.err == nil {
+			return second.entry, nil
+		}
+		first = <-primary
+	}
+	if first.err == nil {
+		return first.entry, nil
+	}
+	if second.err == nil {
+		return second.entry, nil
+	}
+	return Entry{}, first.err
+}
+
+// fetchOnce 请求一次远程节点，有版本并且节点支持时按版本获取
+// 对冲请求发给的下一个节点不一定有这个值，总是完整获取
+func (g *Group) fetchOnce(ctx context.Context, peer Fetcher, key string, version uint64) (Entry, error) {
+	if cf, ok := peer.(ConditionalFetcher); ok && version != 0 {
+		return cf.FetchIfChanged(ctx, g.name, key, version)
+	}
+	return fetchEntry(ctx, peer, g.name, key)
+}
+
+type localOnlyKey struct{}
+
+// withLocalOnly 标记请求由收到的节点自己加载，不再转发
+func withLocalOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, localOnlyKey{}, true)
+}
+
+func isLocalOnly(ctx context.Context) bool {
+	v, _ := ctx.Value(localOnlyKey{}).(bool)
+	return v
+}
@@ -1,9 +1,11 @@
 package geecache
 
 import (
+	"context"
 	"fmt"
+	pb "geecache/geecachepb"
 	"geecache/singleflight"
-	"log"
+	"math/rand"
 	"sync"
 	"time"
 )
@@ -23,6 +25,45 @@ func (f GetterFunc) Get(key string) ([]byte, error) {
 	return f(key)
 }
 
+// GetterCtx 可以感知ctx的Getter，调用方放弃时可以取消正在进行的数据库查询
+// Group的getter实现了这个接口时优先调用GetContext
+type GetterCtx interface {
+	GetContext(ctx context.Context, key string) ([]byte, error)
+}
+
+// GetterCtxFunc 接口型函数，同时实现了Getter和GetterCtx，可以直接传给NewGroup
+type GetterCtxFunc func(ctx context.Context, key string) ([]byte, error)
+
+func (f GetterCtxFunc) GetContext(ctx context.Context, key string) ([]byte, error) {
+	return f(ctx, key)
+}
+
+func (f GetterCtxFunc) Get(key string) ([]byte, error) {
+	return f(context.Background(), key)
+}
+
+// GetterWithTTL 加载时同时返回这个值的过期时间，比如配置缓存10秒、用户资料缓存1小时
+// Group的getter实现了这个接口时优先调用它，ttl为0时使用缓存池的过期时间
+type GetterWithTTL interface {
+	GetWithTTL(ctx context.Context, key string) ([]byte, time.Duration, error)
+}
+
+// GetterWithTTLFunc 接口型函数，同时实现了Getter、GetterCtx和GetterWithTTL，可以直接传给NewGroup
+type GetterWithTTLFunc func(ctx context.Context, key string) ([]byte, time.Duration, error)
+
+func (f GetterWithTTLFunc) GetWithTTL(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	return f(ctx, key)
+}
+
+func (f GetterWithTTLFunc) GetContext(ctx context.Context, key string) ([]byte, error) {
+	bytes, _, err := f(ctx, key)
+	return bytes, err
+}
+
+func (f GetterWithTTLFunc) Get(key string) ([]byte, error) {
+	return f.GetContext(context.Background(), key)
+}
+
 type Group struct {
 	//不同缓存池用不同名字
 	name string
@@ -30,6 +71,28 @@ type Group struct {
 	getter Getter
 	//本地主缓存
 	mainCache cache
+	//条目过期前这段时间内被访问时在后台刷新，0表示不刷新
+	refreshWindow time.Duration
+	//正在后台刷新的key
+	refreshing sync.Map
+	//热点缓存，保存一部分从远程节点获取的值，避免热点key每次都走RPC
+	hotCache cache
+	//热点缓存中数据的过期时间
+	hotExpire time.Duration
+	//过期时间随机增加的最大比例，避免同时加载的key同时过期
+	expireJitter float64
+	//从远程节点获取的值，每hotSample个放一个到热点缓存
+	hotSample int
+	//负缓存，记录不存在的key，默认关闭
+	negCache negativeCache
+	//布隆过滤器，拦截一定不存在的key，默认关闭
+	guard bloomGuard
+	//统计信息
+	stats groupStats
+	//日志，默认不输出
+	logger Logger
+	//从远程节点获取的重试、对冲和回退策略
+	fetchPolicy FetchPolicy
 	//选择节点
 	//peers Picker
 	//每个key只访问一次
@@ -45,20 +108,67 @@ var (
 	groups = make(map[string]*Group)
 )
 
-func NewGroup(name string, cacheBytes int64, expire time.Duration, getter Getter) *Group {
+// 清理过期条目的间隔，和lru原来的定时清理一样
+var (
+	purgeInterval = time.Minute
+	purgeOnce     sync.Once
+)
+
+// purgeLoop 定期清除所有缓存池中过期的条目，整个进程一个协程
+func purgeLoop() {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		mu.RLock()
+		gs := make([]*Group, 0, len(groups))
+		for _, g := range groups {
+			gs = append(gs, g)
+		}
+		mu.RUnlock()
+		for _, g := range gs {
+			g.purgeOverdue()
+		}
+	}
+}
+
+// purgeOverdue 清除主缓存、热点缓存和负缓存中过期的条目
+func (g *Group) purgeOverdue() {
+	g.mainCache.purgeOverdue()
+	g.hotCache.purgeOverdue()
+	g.negCache.purgeOverdue()
+}
+
+// NewGroup 创建一个缓存池，policy可选，指定主缓存的淘汰策略，默认LRU
+// 是NewGroupWithOptions的简单包装
+func NewGroup(name string, cacheBytes int64, expire time.Duration, getter Getter, policy ...Policy) *Group {
+	opts := []GroupOption{WithCacheBytes(cacheBytes), WithExpire(expire)}
+	if len(policy) > 0 {
+		opts = append(opts, WithPolicy(policy[0]))
+	}
+	return NewGroupWithOptions(name, getter, opts...)
+}
+
+// NewGroupWithOptions 用可选配置创建一个缓存池
+// 默认缓存池大小不限制，过期时间为defaultExpiration，淘汰策略为LRU
+func NewGroupWithOptions(name string, getter Getter, opts ...GroupOption) *Group {
 	if getter == nil {
 		panic("nil Getter")
 	}
-	mu.Lock()
-	defer mu.Unlock()
 	g := &Group{
 		name:   name,
 		getter: getter,
-		//构造一个单机缓存池只用传缓存池大小
-		mainCache: cache{cacheBytes: cacheBytes},
-		loader:    &singleflight.Group{},
-		Expire:    expire,
+		loader: &singleflight.Group{},
+		Expire: defaultExpiration,
+		//默认抽样10%
+		hotSample: 10,
+		logger:    nopLogger{},
 	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	purgeOnce.Do(func() { go purgeLoop() })
+	mu.Lock()
+	defer mu.Unlock()
 	groups[name] = g
 	return g
 }
@@ -81,35 +191,110 @@ func (g *Group) RegisterPeers(peers Picker) {
 
 // group中的get方法
 func (g *Group) Get(key string) (ByteView, error) {
+	return g.GetContext(context.Background(), key)
+}
+
+// GetContext 和Get一样，ctx的超时和取消会传递给singleflight、远程节点和Getter
+func (g *Group) GetContext(ctx context.Context, key string) (ByteView, error) {
 	if key == "" {
 		return ByteView{}, fmt.Errorf("key is required")
 	}
+	g.stats.gets.Add(1)
 	//找到
-	if v, ok := g.mainCache.get(key); ok {
-		log.Println("[Geechche] hit")
+	if v, ok := g.lookupCache(key); ok {
 		return v, nil
 	}
+	//最近确认过不存在
+	if err, ok := g.lookupNegative(key); ok {
+		return ByteView{}, err
+	}
+	if err := g.rejectByBloom(key); err != nil {
+		return ByteView{}, err
+	}
 	//没有
-	return g.load(key)
+	if err := ctx.Err(); err != nil {
+		return ByteView{}, err
+	}
+	v, err := g.load(ctx, key)
+	if err != nil {
+		//加载失败时使用保留期内的旧值
+		if stale, ok := g.staleOnError(ctx, key, err); ok {
+			return stale, nil
+		}
+	}
+	return v, err
 
 }
 
+// 依次查找主缓存和热点缓存
+func (g *Group) lookupCache(key string) (ByteView, bool) {
+	if v, expire, ok := g.mainCache.getWithExpire(key); ok {
+		g.logger.Debug("cache hit", "group", g.name, "key", key)
+		g.stats.hits.Add(1)
+		g.maybeRefresh(key, expire)
+		return v, true
+	}
+	if g.hotCache.cacheBytes > 0 {
+		if v, ok := g.hotCache.get(key); ok {
+			g.logger.Debug("hot cache hit", "group", g.name, "key", key)
+			g.stats.hits.Add(1)
+			return v, true
+		}
+	}
+	g.stats.misses.Add(1)
+	return ByteView{}, false
+}
+
 // 使用 PickPeer() 方法选择节点，若非本机节点，则调用 getFromPeer() 从远程获取。若是本机节点或失败，则回退到 getLocally()。
-func (g *Group) load(key string) (value ByteView, err error) {
+func (g *Group) load(ctx context.Context, key string) (value ByteView, err error) {
+	g.stats.loads.Add(1)
 	//使用do函数，让key只去查询一次远程和获取一次远程的值
-	view, err := g.loader.Do(key, func() (interface{}, error) {
+	view, err := g.loader.DoContext(ctx, key, func(ctx context.Context) (interface{}, error) {
+		g.stats.loadsDeduped.Add(1)
 		if g.server != nil {
 			// 返回rpc客户端
 			if peer, ok := g.server.Pick(key); ok {
 				// 使用客户端与rpc服务端连接，调用rpc方法
-				if bytes, err := peer.Fetch(g.name, key); err == nil {
-					return ByteView{cloneBytes(bytes)}, nil
+				// 热点缓存中有过期的副本时带着版本获取，值没有变化就不用再传输
+				stale, hasStale := g.hotCache.getStale(key)
+				var version uint64
+				if hasStale {
+					version = stale.Version()
+				}
+				entry, err := g.fetchFromPeer(ctx, peer, key, version)
+				if err == nil {
+					g.stats.peerLoads.Add(1)
+					g.learnKey(key)
+					if entry.NotModified && hasStale {
+						g.stats.peerNotModified.Add(1)
+						if ttl, ok := g.hotTTL(entry.Expire); ok {
+							g.hotCache.add(key, stale, ttl)
+						}
+						stale.expire = entry.Expire
+						return stale, nil
+					}
+					value := ByteView{b: cloneBytes(entry.Value), version: entry.Version, expire: entry.Expire}
+					g.populateHotCache(key, value, entry.Expire)
+					return value, nil
+				}
+				g.stats.peerErrors.Add(1)
+				// 调用方已经放弃了，不再回退到本地
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				// 负责的节点确认不存在，或者配置了失败时不回退
+				if classifyFetchError(err) == kindNotFound {
+					g.negCache.add(key, err)
+					return nil, err
 				}
-				log.Println("[GeeCache] Failed to get from peer", err)
+				if g.fetchPolicy.FailFast {
+					return nil, err
+				}
+				g.logger.Warn("get from peer failed, loading locally", "group", g.name, "key", key, "err", err)
 			}
 		}
 		//本地去获取db并缓存到本地
-		return g.getLocally(key)
+		return g.getLocally(ctx, key)
 	})
 	if err == nil {
 		return view.(ByteView), nil
@@ -137,20 +322,199 @@ func (g *Group) load(key string) (value ByteView, err error) {
 //}
 
 // 未命中从数据源的get中获取key的值，缓存到本地
-func (g *Group) getLocally(key string) (ByteView, error) {
-	bytes, err := g.getter.Get(key)
+func (g *Group) getLocally(ctx context.Context, key string) (ByteView, error) {
+	var bytes []byte
+	var ttl time.Duration
+	var err error
+	switch getter := g.getter.(type) {
+	case GetterWithTTL:
+		bytes, ttl, err = getter.GetWithTTL(ctx, key)
+	case GetterCtx:
+		bytes, err = getter.GetContext(ctx, key)
+	default:
+		bytes, err = g.getter.Get(key)
+	}
 	if err != nil {
+		g.stats.localLoadErrs.Add(1)
+		g.negCache.add(key, err)
 		return ByteView{}, err
 	}
+	g.stats.localLoads.Add(1)
+	g.learnKey(key)
 	//获取成功克隆一份，对于ByteView这个类型的值的操作，都在ByteView文件里
 	//同一个包可以调用函数，从db取数据要深拷贝一份
 	value := ByteView{b: cloneBytes(bytes)}
-	g.populateCache(key, value)
+	value.expire = g.populateCache(key, value, ttl)
 	return value, nil
 
 }
 
 // 添加到主缓存池中,也要加入传给缓存池的过期时间
-func (g *Group) populateCache(key string, value ByteView) {
-	g.mainCache.add(key, value, g.Expire)
+// ttl是Getter返回的过期时间，为0时使用缓存池的过期时间，返回过期的时间点，不过期时为零值
+func (g *Group) populateCache(key string, value ByteView, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		ttl = g.Expire
+	}
+	ttl = g.jitter(ttl)
+	g.mainCache.add(key, value, ttl)
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+// jitter 过期时间随机增加[0, ttl*expireJitter)，0表示不过期，保持不变
+func (g *Group) jitter(ttl time.Duration) time.Duration {
+	if g.expireJitter <= 0 || ttl <= 0 {
+		return ttl
+	}
+	if n := int64(float64(ttl) * g.expireJitter); n > 0 {
+		ttl += time.Duration(rand.Int63n(n))
+	}
+	return ttl
+}
+
+// 抽样把远程节点的值放到热点缓存，热点key被访问得多，更容易被抽中
+// expire是负责节点上这个值过期的时间点，副本不会比它晚过期
+func (g *Group) populateHotCache(key string, value ByteView, expire time.Time) {
+	if g.hotCache.cacheBytes <= 0 {
+		return
+	}
+	ttl, ok := g.hotTTL(expire)
+	if !ok {
+		return
+	}
+	if g.hotSample > 1 && rand.Intn(g.hotSample) != 0 {
+		return
+	}
+	g.hotCache.add(key, value, ttl)
+}
+
+// hotTTL 副本在热点缓存中的过期时间，不超过负责节点上剩下的时间
+// 负责节点上已经过期了(比如加载失败时返回的旧值)时不缓存
+func (g *Group) hotTTL(expire time.Time) (time.Duration, bool) {
+	ttl := g.jitter(g.hotExpire)
+	if !expire.IsZero() {
+		remain := time.Until(expire)
+		if remain <= 0 {
+			return 0, false
+		}
+		if ttl <= 0 || remain < ttl {
+			ttl = remain
+		}
+	}
+	return ttl, true
+}
+
+// fillResponse 填充返回给远程节点的值、过期时间和版本
+// 过期时间是取出或者加载这个值时一起得到的，不再查一次缓存
+func fillResponse(resp *pb.Response, value ByteView) {
+	resp.Value = value.ByteSlice()
+	resp.Expire = expireToMillis(value.expire)
+	resp.Version = value.Version()
+}
+
+// NoExpiration 作为Set的ttl时写入的值不过期，0表示使用缓存池的过期时间
+const NoExpiration time.Duration = -1
+
+// Set 写入一个值，ttl为0时使用缓存池的过期时间，小于0(比如NoExpiration)时不过期
+func (g *Group) Set(key string, value []byte, ttl time.Duration) error {
+	return g.SetContext(context.Background(), key, value, ttl)
+}
+
+// SetContext 写入一个值，写到负责这个key的节点，其他节点上的副本会被清除
+func (g *Group) SetContext(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if key == "" {
+		return fmt.Errorf("key is required")
+	}
+	g.addKey(key)
+	if g.server != nil {
+		// 不是自己负责的key，交给远程节点
+		if peer, ok := g.pickOwner(key); ok {
+			w, ok := peer.(WritableFetcher)
+			if !ok {
+				return fmt.Errorf("could not set %s/%s: peer %T does not support Set", g.name, key, peer)
+			}
+			// 自己的副本也要清除
+			g.removeLocally(key)
+			return w.Set(ctx, g.name, key, value, ttl)
+		}
+	}
+	switch {
+	case ttl == 0:
+		ttl = g.Expire
+	case ttl < 0:
+		ttl = 0
+	}
+	g.hotCache.remove(key)
+	g.negCache.remove(key)
+	g.mainCache.add(key, ByteView{b: cloneBytes(value)}, ttl)
+	g.purgePeers(ctx, key)
+	return nil
+}
+
+// Remove 删除一个值
+func (g *Group) Remove(key string) error {
+	return g.RemoveContext(context.Background(), key)
+}
+
+// RemoveContext 删除一个值，在负责这个key的节点删除，其他节点上的副本会被清除
+func (g *Group) RemoveContext(ctx context.Context, key string) error {
+	if key == "" {
+		return fmt.Errorf("key is required")
+	}
+	if g.server != nil {
+		if peer, ok := g.pickOwner(key); ok {
+			w, ok := peer.(WritableFetcher)
+			if !ok {
+				return fmt.Errorf("could not delete %s/%s: peer %T does not support Delete", g.name, key, peer)
+			}
+			// 自己也可能有副本
+			g.removeLocally(key)
+			return w.Delete(ctx, g.name, key, false)
+		}
+	}
+	g.removeLocally(key)
+	g.purgePeers(ctx, key)
+	return nil
+}
+
+// pickOwner 写入和删除时选择负责key的节点，Picker实现了OwnerPicker时熔断的节点也会选中，
+// 请求由它的熔断器拒绝，不会写到不负责的节点
+func (g *Group) pickOwner(key string) (Fetcher, bool) {
+	if op, ok := g.server.(OwnerPicker); ok {
+		return op.Owner(key)
+	}
+	return g.server.Pick(key)
+}
+
+// 删除本节点的副本
+func (g *Group) removeLocally(key string) {
+	g.hotCache.remove(key)
+	g.mainCache.remove(key)
+	g.negCache.remove(key)
+}
+
+// 通知其他节点清除这个key的副本，失败只记录日志，副本最终也会过期
+// Picker没有实现PeerLister或者节点没有实现WritableFetcher时跳过
+func (g *Group) purgePeers(ctx context.Context, key string) {
+	lister, ok := g.server.(PeerLister)
+	if !ok {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, peer := range lister.Peers() {
+		w, ok := peer.(WritableFetcher)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(peer WritableFetcher) {
+			defer wg.Done()
+			if err := peer.Delete(ctx, g.name, key, true); err != nil {
+				g.logger.Warn("purge peer failed", "group", g.name, "key", key, "err", err)
+			}
+		}(w)
+	}
+	wg.Wait()
 }
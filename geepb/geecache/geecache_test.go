@@ -1,10 +1,27 @@
 package geecache
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
+	"geecache/bloom"
+	pb "geecache/geecachepb"
 	"log"
+	"log/slog"
+	"net"
+	"net/http/httptest"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestGetter(t *testing.T) {
@@ -28,7 +45,7 @@ var db = map[string]string{
 
 func TestGet(t *testing.T) {
 	loadCounts := make(map[string]int, len(db))
-	gee := NewGroup("scores", 2<<10, GetterFunc(
+	gee := NewGroup("scores", 2<<10, time.Minute, GetterFunc(
 		func(key string) ([]byte, error) {
 			log.Println("[SlowDB] search key", key)
 			if v, ok := db[key]; ok {
@@ -54,3 +71,1763 @@ func TestGet(t *testing.T) {
 		t.Fatalf("the value of unknow should be empty, but %s got", view)
 	}
 }
+
+func TestPolicy(t *testing.T) {
+	policies := map[string]Policy{"lru": LRU, "lfu": LFU, "hashlru": HashLRU, "arc": ARC}
+	for name, policy := range policies {
+		loads := 0
+		gee := NewGroup("policy-"+name, 2<<10, time.Minute, GetterFunc(
+			func(key string) ([]byte, error) {
+				loads++
+				return []byte(key), nil
+			}), policy)
+		for i := 0; i < 2; i++ {
+			if view, err := gee.Get("Tom"); err != nil || view.String() != "Tom" {
+				t.Fatalf("%s: failed to get Tom", name)
+			}
+		}
+		if loads != 1 {
+			t.Fatalf("%s: cache Tom miss, loads = %d", name, loads)
+		}
+	}
+}
+
+func TestPolicyEvict(t *testing.T) {
+	for _, policy := range []Policy{LRU, LFU, HashLRU, ARC} {
+		// 每个条目占 len(key)+len(value)=2 字节
+		s := policy.NewStore(10, nil)
+		for _, k := range []string{"a", "b", "c", "d", "e", "f"} {
+			s.Add(k, ByteView{b: []byte(k)}, 0)
+		}
+		if s.Bytes() > 10 || s.Len() != 5 {
+			t.Fatalf("bad bytes %d or len %d", s.Bytes(), s.Len())
+		}
+		if !s.Remove("f") || s.Remove("f") {
+			t.Fatalf("remove f failed")
+		}
+		if _, ok := s.Get("f"); ok || s.Bytes() != 8 {
+			t.Fatalf("f should be removed, bytes %d", s.Bytes())
+		}
+
+		// 只按字节数淘汰，HashLRU同一个分片的key不会在还有空间时互相淘汰
+		s = policy.NewStore(30, nil)
+		for i := 0; i < 1000; i++ {
+			s.Add(fmt.Sprintf("%03d", i), ByteView{}, 0)
+		}
+		if s.Bytes() != 30 || s.Len() != 10 {
+			t.Fatalf("bad bytes %d or len %d", s.Bytes(), s.Len())
+		}
+	}
+}
+
+// 没有访问的过期条目也会被定期清除
+func TestPurgeOverdue(t *testing.T) {
+	for name, policy := range map[string]Policy{"lru": LRU, "lfu": LFU, "hashlru": HashLRU, "arc": ARC} {
+		c := &cache{policy: policy}
+		c.add("short", ByteView{b: []byte("1")}, 10*time.Millisecond)
+		c.add("long", ByteView{b: []byte("2")}, time.Hour)
+		time.Sleep(20 * time.Millisecond)
+		c.purgeOverdue()
+		if s := c.stats(); s.Items != 1 || s.Bytes != int64(len("long")+1) || s.Evictions != 1 {
+			t.Fatalf("%s: bad stats after purge %+v", name, s)
+		}
+		if v, ok := c.get("long"); !ok || v.String() != "2" {
+			t.Fatalf("%s: long should survive the purge", name)
+		}
+	}
+}
+
+func TestNewGroupWithOptions(t *testing.T) {
+	gee := NewGroupWithOptions("options", GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}),
+		WithCacheBytes(2<<10),
+		WithExpire(time.Second),
+		WithPolicy(ARC))
+	if gee != GetGroup("options") {
+		t.Fatalf("group options not registered")
+	}
+	if gee.mainCache.cacheBytes != 2<<10 || gee.Expire != time.Second || gee.mainCache.policy == nil {
+		t.Fatalf("options not applied")
+	}
+	if view, err := gee.Get("Tom"); err != nil || view.String() != "Tom" {
+		t.Fatalf("failed to get Tom")
+	}
+}
+
+func TestGetContext(t *testing.T) {
+	type ctxKey struct{}
+	gee := NewGroup("context", 2<<10, time.Minute, GetterCtxFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			// ctx 要传到Getter
+			if ctx.Value(ctxKey{}) == nil {
+				return nil, fmt.Errorf("ctx not passed")
+			}
+			return []byte(key), nil
+		}))
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, true)
+	if view, err := gee.GetContext(ctx, "Tom"); err != nil || view.String() != "Tom" {
+		t.Fatalf("failed to get Tom: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := gee.GetContext(ctx, "Jack"); err != context.Canceled {
+		t.Fatalf("err = %v; want %v", err, context.Canceled)
+	}
+}
+
+// 测试用的远程节点，所有key都由它负责
+type fakePeer struct {
+	fetches int
+	batches int
+	deletes int
+	values  map[string][]byte
+	// 返回的值在负责节点上的过期时间
+	expire time.Time
+}
+
+func (p *fakePeer) Pick(key string) (Fetcher, bool) {
+	return p, true
+}
+
+func (p *fakePeer) Peers() []Fetcher {
+	return []Fetcher{p}
+}
+
+func (p *fakePeer) Fetch(ctx context.Context, group string, key string) ([]byte, error) {
+	e, err := p.FetchEntry(ctx, group, key)
+	return e.Value, err
+}
+
+func (p *fakePeer) FetchEntry(ctx context.Context, group string, key string) (Entry, error) {
+	p.fetches++
+	if v, ok := p.values[key]; ok {
+		return Entry{Value: v, Expire: p.expire}, nil
+	}
+	return Entry{Value: []byte(key), Expire: p.expire}, nil
+}
+
+func (p *fakePeer) Set(ctx context.Context, group string, key string, value []byte, ttl time.Duration) error {
+	if p.values == nil {
+		p.values = make(map[string][]byte)
+	}
+	p.values[key] = value
+	return nil
+}
+
+func (p *fakePeer) BatchFetch(ctx context.Context, group string, keys []string) (map[string]Entry, map[string]error, error) {
+	p.batches++
+	values := make(map[string]Entry)
+	for _, key := range keys {
+		values[key], _ = p.FetchEntry(ctx, group, key)
+	}
+	return values, nil, nil
+}
+
+func (p *fakePeer) Delete(ctx context.Context, group string, key string, localOnly bool) error {
+	p.deletes++
+	delete(p.values, key)
+	return nil
+}
+
+func TestHotCache(t *testing.T) {
+	peer := &fakePeer{}
+	gee := NewGroupWithOptions("hot", GetterFunc(
+		func(key string) ([]byte, error) {
+			return nil, fmt.Errorf("%s should be loaded from peer", key)
+		}),
+		WithPeers(peer),
+		WithHotCache(2<<10, time.Minute),
+		WithHotCacheSample(1))
+
+	for i := 0; i < 3; i++ {
+		if view, err := gee.Get("Tom"); err != nil || view.String() != "Tom" {
+			t.Fatalf("failed to get Tom: %v", err)
+		}
+	}
+	if peer.fetches != 1 {
+		t.Fatalf("Tom should be fetched from peer once, got %d", peer.fetches)
+	}
+	if stats := gee.HotCacheStats(); stats.Hits != 2 || stats.Items != 1 {
+		t.Fatalf("bad hot cache stats %+v", stats)
+	}
+}
+
+// 热点缓存中的副本不会比负责节点上的值晚过期
+func TestHotCacheExpire(t *testing.T) {
+	peer := &fakePeer{expire: time.Now().Add(20 * time.Millisecond)}
+	gee := NewGroupWithOptions("hot-expire", GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}),
+		WithPeers(peer),
+		WithHotCache(2<<10, time.Hour),
+		WithHotCacheSample(1))
+
+	gee.Get("Tom")
+	gee.Get("Tom")
+	if peer.fetches != 1 {
+		t.Fatalf("second get should hit the hot cache, fetches %d", peer.fetches)
+	}
+	time.Sleep(30 * time.Millisecond)
+	gee.Get("Tom")
+	if peer.fetches != 2 {
+		t.Fatalf("hot copy should expire with the owner, fetches %d", peer.fetches)
+	}
+
+	// 负责节点上已经过期的值不放到热点缓存
+	gee.Get("Jack")
+	gee.Get("Jack")
+	if peer.fetches != 4 {
+		t.Fatalf("expired value should not be cached, fetches %d", peer.fetches)
+	}
+}
+
+// condPeer 支持按版本获取的fakePeer
+type condPeer struct {
+	fakePeer
+	notModified int
+}
+
+func (p *condPeer) Pick(key string) (Fetcher, bool) {
+	return p, true
+}
+
+func (p *condPeer) FetchIfChanged(ctx context.Context, group string, key string, version uint64) (Entry, error) {
+	e, err := p.FetchEntry(ctx, group, key)
+	if err == nil && version == valueVersion(e.Value) {
+		p.notModified++
+		return Entry{Expire: e.Expire, Version: version, NotModified: true}, nil
+	}
+	return e, err
+}
+
+// 热点缓存中过期的副本按版本重新验证
+func TestHotCacheRevalidate(t *testing.T) {
+	peer := &condPeer{}
+	gee := NewGroupWithOptions("hot-revalidate", GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}),
+		WithPeers(peer),
+		WithHotCache(2<<10, 20*time.Millisecond),
+		WithHotCacheSample(1),
+		WithHotCacheRevalidate(time.Second))
+
+	gee.Get("Tom")
+	time.Sleep(30 * time.Millisecond)
+	if v, err := gee.Get("Tom"); err != nil || v.String() != "Tom" {
+		t.Fatalf("bad value %v, err %v", v, err)
+	}
+	if peer.fetches != 2 || peer.notModified != 1 {
+		t.Fatalf("should revalidate, fetches %d, not modified %d", peer.fetches, peer.notModified)
+	}
+	// 重新验证后副本继续有效
+	gee.Get("Tom")
+	if peer.fetches != 2 {
+		t.Fatalf("revalidated copy should be cached, fetches %d", peer.fetches)
+	}
+
+	// 值变化了，返回新值
+	peer.Set(context.Background(), "hot-revalidate", "Tom", []byte("new"), 0)
+	time.Sleep(30 * time.Millisecond)
+	if v, _ := gee.Get("Tom"); v.String() != "new" || peer.notModified != 1 {
+		t.Fatalf("should fetch the new value, got %s", v)
+	}
+	if s := gee.Stats(); s.PeerNotModified != 1 {
+		t.Fatalf("bad not modified count %d", s.PeerNotModified)
+	}
+}
+
+func TestSetRemove(t *testing.T) {
+	loads := 0
+	gee := NewGroup("set", 2<<10, time.Minute, GetterFunc(
+		func(key string) ([]byte, error) {
+			loads++
+			return []byte("db"), nil
+		}))
+	if err := gee.Set("Tom", []byte("630"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if view, err := gee.Get("Tom"); err != nil || view.String() != "630" || loads != 0 {
+		t.Fatalf("Tom should be set to 630, got %s", view)
+	}
+	if err := gee.Remove("Tom"); err != nil {
+		t.Fatal(err)
+	}
+	if view, err := gee.Get("Tom"); err != nil || view.String() != "db" || loads != 1 {
+		t.Fatalf("Tom should be loaded again after remove, got %s", view)
+	}
+
+	// ttl为0时使用缓存池的过期时间，NoExpiration不过期
+	gee.Set("Jack", []byte("589"), 0)
+	if _, expire, ok := gee.mainCache.getWithExpire("Jack"); !ok || expire.IsZero() {
+		t.Fatalf("Jack should expire with the group, expire %v", expire)
+	}
+	gee.Set("Jack", []byte("589"), NoExpiration)
+	if _, expire, ok := gee.mainCache.getWithExpire("Jack"); !ok || !expire.IsZero() {
+		t.Fatalf("Jack should never expire, expire %v", expire)
+	}
+}
+
+func TestSetRemovePeer(t *testing.T) {
+	peer := &fakePeer{}
+	gee := NewGroupWithOptions("set-peer", GetterFunc(
+		func(key string) ([]byte, error) {
+			return nil, fmt.Errorf("%s should be loaded from peer", key)
+		}),
+		WithPeers(peer),
+		WithHotCache(2<<10, time.Minute),
+		WithHotCacheSample(1))
+
+	gee.Get("Tom")
+	// 写到负责的节点，本地的热点副本要清除
+	if err := gee.Set("Tom", []byte("630"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if view, err := gee.Get("Tom"); err != nil || view.String() != "630" {
+		t.Fatalf("Tom should be set on peer, got %s", view)
+	}
+	if err := gee.Remove("Tom"); err != nil || peer.deletes != 1 {
+		t.Fatalf("Tom should be deleted on peer")
+	}
+	if _, ok := gee.hotCache.get("Tom"); ok {
+		t.Fatalf("hot copy of Tom should be removed")
+	}
+}
+
+// plainPeer 只实现了Picker和Fetcher，没有任何可选接口
+type plainPeer struct {
+	fetches atomic.Int32
+}
+
+func (p *plainPeer) Pick(key string) (Fetcher, bool) {
+	return p, true
+}
+
+func (p *plainPeer) Fetch(ctx context.Context, group string, key string) ([]byte, error) {
+	p.fetches.Add(1)
+	return []byte("v-" + key), nil
+}
+
+// 只实现了必须方法的Picker和Fetcher也能用，不支持的写入返回错误
+func TestPlainPeer(t *testing.T) {
+	peer := &plainPeer{}
+	gee := NewGroupWithOptions("plain-peer", GetterFunc(
+		func(key string) ([]byte, error) {
+			return nil, fmt.Errorf("%s should be loaded from peer", key)
+		}),
+		WithPeers(peer),
+		WithHotCache(2<<10, time.Minute),
+		WithHotCacheSample(1))
+
+	if view, err := gee.Get("Tom"); err != nil || view.String() != "v-Tom" {
+		t.Fatalf("bad value %s, err %v", view, err)
+	}
+	// 没有负责节点的过期时间，副本按热点缓存的过期时间
+	if _, expire, ok := gee.hotCache.getWithExpire("Tom"); !ok || time.Until(expire) <= 0 {
+		t.Fatalf("Tom should be in the hot cache, expire %v", expire)
+	}
+	// 不支持批量获取时逐个获取
+	values, errs := gee.GetMany(context.Background(), []string{"Jack", "Sam"})
+	if len(errs) != 0 || values["Jack"].String() != "v-Jack" || values["Sam"].String() != "v-Sam" {
+		t.Fatalf("bad values %v, errs %v", values, errs)
+	}
+	if n := peer.fetches.Load(); n != 3 {
+		t.Fatalf("should fetch each key once, fetched %d", n)
+	}
+	if err := gee.Set("Tom", []byte("630"), 0); err == nil {
+		t.Fatal("Set should fail when the peer does not support it")
+	}
+	if err := gee.Remove("Tom"); err == nil {
+		t.Fatal("Remove should fail when the peer does not support it")
+	}
+}
+
+// 一半的key由远程节点负责
+type halfPeer struct {
+	fakePeer
+}
+
+func (p *halfPeer) Pick(key string) (Fetcher, bool) {
+	if key[0]%2 == 0 {
+		return p, true
+	}
+	return nil, false
+}
+
+// missingPeer 批量获取时missing不存在
+type missingPeer struct {
+	fakePeer
+}
+
+func (p *missingPeer) Pick(key string) (Fetcher, bool) {
+	return p, true
+}
+
+func (p *missingPeer) BatchFetch(ctx context.Context, group string, keys []string) (map[string]Entry, map[string]error, error) {
+	values, errs, err := p.fakePeer.BatchFetch(ctx, group, keys)
+	delete(values, "missing")
+	errs = map[string]error{"missing": fmt.Errorf("%w: %s/missing", ErrNotFound, group)}
+	return values, errs, err
+}
+
+// 远程节点批量返回的不存在和本地加载的一样，可以匹配ErrNotFound，并记到负缓存
+func TestGetManyNotFound(t *testing.T) {
+	peer := &missingPeer{}
+	gee := NewGroupWithOptions("many-missing", GetterFunc(
+		func(key string) ([]byte, error) {
+			return nil, fmt.Errorf("%s should be loaded from peer", key)
+		}),
+		WithPeers(peer),
+		WithNegativeCache(0, time.Minute))
+	_, errs := gee.GetMany(context.Background(), []string{"Tom", "missing"})
+	if len(errs) != 1 || !errors.Is(errs["missing"], ErrNotFound) {
+		t.Fatalf("missing should be ErrNotFound: %v", errs)
+	}
+	if _, err := gee.Get("missing"); !errors.Is(err, ErrNotFound) || peer.batches != 1 || peer.fetches != 2 {
+		t.Fatalf("missing should hit the negative cache, err %v, batches %d, fetches %d", err, peer.batches, peer.fetches)
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	peer := &halfPeer{}
+	loads := 0
+	var mu sync.Mutex
+	gee := NewGroupWithOptions("many", GetterFunc(
+		func(key string) ([]byte, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			loads++
+			if key == "c" {
+				return nil, fmt.Errorf("%s not exist", key)
+			}
+			return []byte(key), nil
+		}),
+		WithPeers(peer))
+
+	values, errs := gee.GetMany(context.Background(), []string{"a", "b", "c", "d", "e", "f", "a"})
+	if len(values) != 5 || len(errs) != 1 || errs["c"] == nil {
+		t.Fatalf("bad result %v %v", values, errs)
+	}
+	for k, v := range values {
+		if v.String() != k {
+			t.Fatalf("bad value of %s: %s", k, v)
+		}
+	}
+	// b d f 由远程节点负责，一次请求
+	if peer.batches != 1 || peer.fetches != 3 || loads != 3 {
+		t.Fatalf("bad batches %d fetches %d loads %d", peer.batches, peer.fetches, loads)
+	}
+}
+
+func TestStats(t *testing.T) {
+	peer := &halfPeer{}
+	gee := NewGroupWithOptions("stats", GetterFunc(
+		func(key string) ([]byte, error) {
+			if key == "c" {
+				return nil, fmt.Errorf("%s not exist", key)
+			}
+			return []byte(key), nil
+		}),
+		WithPeers(peer),
+		WithCacheBytes(4))
+
+	for _, key := range []string{"a", "a", "b", "c"} {
+		gee.Get(key)
+	}
+	stats := gee.Stats()
+	want := Stats{Gets: 4, Hits: 1, Misses: 3, Loads: 3, LoadsDeduped: 3,
+		PeerLoads: 1, LocalLoads: 1, LocalLoadErrs: 1}
+	if stats != want {
+		t.Fatalf("bad stats %+v, want %+v", stats, want)
+	}
+
+	// 每个条目2字节，只能放下两个
+	for _, key := range []string{"e", "g", "i"} {
+		gee.Get(key)
+	}
+	if cs := gee.CacheStats(); cs.Items != 2 || cs.Bytes != 4 || cs.Evictions != 2 {
+		t.Fatalf("bad cache stats %+v", cs)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	errBusy := errors.New("db busy")
+	loads := make(map[string]int)
+	gee := NewGroupWithOptions("negative", GetterFunc(
+		func(key string) ([]byte, error) {
+			loads[key]++
+			switch key {
+			case "missing":
+				return nil, fmt.Errorf("%s not exist: %w", key, ErrNotFound)
+			case "busy":
+				return nil, errBusy
+			}
+			return []byte(key), nil
+		}),
+		WithNegativeCache(0, 50*time.Millisecond))
+
+	for i := 0; i < 3; i++ {
+		_, err := gee.Get("missing")
+		if !errors.Is(err, ErrNotFound) || err.Error() != "missing not exist: "+ErrNotFound.Error() {
+			t.Fatalf("bad error: %v", err)
+		}
+		// 不可缓存的错误每次都查数据库
+		if _, err := gee.Get("busy"); !errors.Is(err, errBusy) {
+			t.Fatalf("bad error: %v", err)
+		}
+	}
+	if loads["missing"] != 1 || loads["busy"] != 3 {
+		t.Fatalf("bad loads %v", loads)
+	}
+	if s := gee.Stats(); s.NegativeHits != 2 {
+		t.Fatalf("bad negative hits %d", s.NegativeHits)
+	}
+
+	// 过期后重新查询
+	time.Sleep(60 * time.Millisecond)
+	gee.Get("missing")
+	if loads["missing"] != 2 {
+		t.Fatalf("negative entry should expire, loads %d", loads["missing"])
+	}
+
+	// 写入后负缓存失效
+	gee.Set("missing", []byte("here"), 0)
+	if v, err := gee.Get("missing"); err != nil || v.String() != "here" {
+		t.Fatalf("bad value %v, err %v", v, err)
+	}
+
+	// 大小不能不限制，过期的条目会被清理
+	if gee.negCache.cacheBytes != defaultNegativeBytes {
+		t.Fatalf("negative cache should default to %d bytes, got %d", defaultNegativeBytes, gee.negCache.cacheBytes)
+	}
+	small := NewGroupWithOptions("negative-small", GetterFunc(
+		func(key string) ([]byte, error) {
+			return nil, ErrNotFound
+		}),
+		WithNegativeCache(1<<10, 20*time.Millisecond))
+	for i := 0; i < 1000; i++ {
+		small.Get("random-" + strconv.Itoa(i))
+	}
+	if cs := small.NegativeCacheStats(); cs.Bytes > 1<<10 {
+		t.Fatalf("negative cache should stay within its budget: %+v", cs)
+	}
+	time.Sleep(30 * time.Millisecond)
+	small.purgeOverdue()
+	if cs := small.NegativeCacheStats(); cs.Items != 0 || cs.Bytes != 0 {
+		t.Fatalf("expired negative entries should be purged: %+v", cs)
+	}
+
+	// 默认不开启
+	plain := NewGroupWithOptions("negative-off", GetterFunc(
+		func(key string) ([]byte, error) {
+			loads[key]++
+			return nil, ErrNotFound
+		}))
+	plain.Get("off")
+	plain.Get("off")
+	if loads["off"] != 2 {
+		t.Fatalf("negative cache should be opt-in, loads %d", loads["off"])
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	loads := make(map[string]int)
+	getter := GetterFunc(func(key string) ([]byte, error) {
+		loads[key]++
+		if v, ok := db[key]; ok {
+			return []byte(v), nil
+		}
+		return nil, fmt.Errorf("%s not exist: %w", key, ErrNotFound)
+	})
+	peer := &halfPeer{}
+	gee := NewGroupWithOptions("bloom", getter, WithPeers(peer),
+		WithBloomFilter(bloom.FromKeys([]string{"Tom", "Jack", "Sam"}, 0.01)))
+
+	for _, key := range []string{"Tom", "Jack", "Sam"} {
+		if _, err := gee.Get(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 不存在的key不访问远程节点也不调用Getter
+	for _, key := range []string{"Bob", "Bob", "Alice"} {
+		if _, err := gee.Get(key); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("%s should be rejected: %v", key, err)
+		}
+	}
+	if _, errs := gee.GetMany(context.Background(), []string{"Bob", "Eve"}); len(errs) != 2 {
+		t.Fatalf("bad errs %v", errs)
+	}
+	if loads["Bob"] != 0 || loads["Alice"] != 0 || len(loads)+peer.fetches != 3 {
+		t.Fatalf("rejected keys should not be loaded: %v, peer fetches %d", loads, peer.fetches)
+	}
+	if s := gee.Stats(); s.BloomRejects != 5 {
+		t.Fatalf("bad bloom rejects %d", s.BloomRejects)
+	}
+
+	// 重建后新的key放行
+	gee.RebuildBloomFilter([]string{"Tom", "Jack", "Sam", "Bob"})
+	gee.Get("Bob")
+	if s := gee.Stats(); s.BloomRejects != 5 || len(loads)+peer.fetches != 4 {
+		t.Fatalf("Bob should pass the rebuilt filter, bloom rejects %d", s.BloomRejects)
+	}
+
+	// 快照加载到另一个节点
+	var buf bytes.Buffer
+	if _, err := gee.BloomFilter().WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	f, err := bloom.ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := NewGroupWithOptions("bloom-snapshot", getter)
+	other.SetBloomFilter(f)
+	if _, err := other.Get("Sam"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Get("Alice"); !errors.Is(err, ErrNotFound) || loads["Alice"] != 0 {
+		t.Fatalf("Alice should be rejected by the snapshot: %v", err)
+	}
+}
+
+// 两个节点：非负责节点Set一个新key，两边的过滤器都加入它，不会被当作不存在拦截
+func TestBloomSetTwoNodes(t *testing.T) {
+	addrA, addrB := freeAddr(t), freeAddr(t)
+	svrA, err := NewServer(addrA, WithStaticPeers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svrA.conns.Close()
+	svrA.SetPeers(addrB)
+	// 同名的缓存池，B后创建，B的server处理的是B
+	a := NewGroupWithOptions("bloom-set", GetterFunc(
+		func(key string) ([]byte, error) {
+			return nil, fmt.Errorf("%s should be loaded from peer", key)
+		}),
+		WithPeers(svrA),
+		WithBloomFilter(bloom.FromKeys([]string{"Tom"}, 0.01)))
+	b := NewGroupWithOptions("bloom-set", GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("db-" + key), nil
+		}),
+		WithBloomFilter(bloom.FromKeys([]string{"Tom"}, 0.01)))
+	svrB, err := NewServer(addrB, WithStaticPeers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go svrB.Start()
+	defer svrB.Stop()
+	waitListening(t, addrB)
+
+	if err := a.Set("Sam", []byte("630"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := a.Get("Sam"); err != nil || v.String() != "630" {
+		t.Fatalf("Sam should be read from the owner, got %s, err %v", v, err)
+	}
+	// 负责节点上的值过期后从Getter加载，不会被拦截
+	b.mainCache.remove("Sam")
+	if v, err := b.Get("Sam"); err != nil || v.String() != "db-Sam" {
+		t.Fatalf("Sam should not be rejected on the owner, got %s, err %v", v, err)
+	}
+
+	// 清除副本的请求也把key加入收到的节点的过滤器
+	peer, _ := svrA.Pick("Ann")
+	if err := peer.(WritableFetcher).Delete(context.Background(), "bloom-set", "Ann", true); err != nil {
+		t.Fatal(err)
+	}
+	if !b.BloomFilter().Test("Ann") {
+		t.Fatal("purged key should be added to the filter")
+	}
+}
+
+func TestBloomLearning(t *testing.T) {
+	rows := map[string]string{"Tom": "630"}
+	var mu sync.Mutex
+	loads := 0
+	gee := NewGroupWithOptions("bloom-learn", GetterFunc(
+		func(key string) ([]byte, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			loads++
+			if v, ok := rows[key]; ok {
+				return []byte(v), nil
+			}
+			return nil, ErrNotFound
+		}),
+		WithExpire(time.Millisecond),
+		WithBloomLearning(100))
+
+	if _, err := gee.Get("Tom"); err != nil {
+		t.Fatal(err)
+	}
+	gee.Set("Jack", []byte("589"), 0)
+	if f := gee.BloomFilter(); !f.Test("Tom") || !f.Test("Jack") {
+		t.Fatal("loaded and set keys should be learned")
+	}
+
+	// 学到的过滤器不完整，之后才写入的key第一次访问也能加载到
+	mu.Lock()
+	rows["Sam"] = "567"
+	mu.Unlock()
+	if v, err := gee.Get("Sam"); err != nil || v.String() != "567" {
+		t.Fatalf("existing key first requested later should load: %v, %v", v, err)
+	}
+	if _, err := gee.Get("Bob"); !errors.Is(err, ErrNotFound) || loads != 3 {
+		t.Fatalf("learning should not reject: %v, loads %d", err, loads)
+	}
+	if s := gee.Stats(); s.BloomRejects != 0 {
+		t.Fatalf("learning should not reject, rejects %d", s.BloomRejects)
+	}
+
+	// 快照加载后拦截，同时继续学习
+	gee.SetBloomFilter(gee.BloomFilter())
+	if _, err := gee.Get("Alice"); !errors.Is(err, ErrNotFound) || loads != 3 {
+		t.Fatalf("Alice should be rejected: %v, loads %d", err, loads)
+	}
+	gee.Set("Alice", []byte("1"), 0)
+	if !gee.BloomFilter().Test("Alice") {
+		t.Fatal("set key should still be learned")
+	}
+}
+
+func TestRefreshAhead(t *testing.T) {
+	var loads atomic.Int64
+	gee := NewGroupWithOptions("refresh", GetterFunc(
+		func(key string) ([]byte, error) {
+			n := loads.Add(1)
+			return []byte(fmt.Sprintf("%s-%d", key, n)), nil
+		}),
+		WithExpire(200*time.Millisecond),
+		WithRefreshAhead(150*time.Millisecond))
+
+	if v, _ := gee.Get("Tom"); v.String() != "Tom-1" {
+		t.Fatalf("bad value %s", v)
+	}
+	// 还没进入刷新窗口
+	gee.Get("Tom")
+	time.Sleep(80 * time.Millisecond)
+	// 进入刷新窗口，先返回旧值，后台刷新一次
+	for i := 0; i < 3; i++ {
+		if v, _ := gee.Get("Tom"); v.String() != "Tom-1" && v.String() != "Tom-2" {
+			t.Fatalf("bad value %s", v)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for loads.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if v, _ := gee.Get("Tom"); v.String() != "Tom-2" {
+		t.Fatalf("should get the refreshed value, got %s", v)
+	}
+	if s := gee.Stats(); s.Refreshes != 1 || loads.Load() != 2 {
+		t.Fatalf("bad refreshes %d, loads %d", s.Refreshes, loads.Load())
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	var fail, missing atomic.Bool
+	gee := NewGroupWithOptions("stale", GetterFunc(
+		func(key string) ([]byte, error) {
+			if missing.Load() {
+				return nil, ErrNotFound
+			}
+			if fail.Load() {
+				return nil, fmt.Errorf("db down")
+			}
+			return []byte("630"), nil
+		}),
+		WithExpire(20*time.Millisecond),
+		WithStaleIfError(time.Second))
+
+	gee.Get("Tom")
+	fail.Store(true)
+	time.Sleep(30 * time.Millisecond)
+	// 过期后加载失败，返回旧值
+	if v, err := gee.Get("Tom"); err != nil || v.String() != "630" {
+		t.Fatalf("should serve the stale value: %v, %v", v, err)
+	}
+	if _, err := gee.Get("Jack"); err == nil {
+		t.Fatal("no stale value for Jack")
+	}
+	if s := gee.Stats(); s.StaleHits != 1 || s.LocalLoadErrs != 2 {
+		t.Fatalf("bad stats %+v", s)
+	}
+	// 旧值不算命中
+	if cs := gee.CacheStats(); cs.Hits != 0 {
+		t.Fatalf("stale value should not count as a hit: %+v", cs)
+	}
+
+	// 数据已经删除时不使用旧值
+	missing.Store(true)
+	if _, err := gee.Get("Tom"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("should be ErrNotFound: %v", err)
+	}
+
+	// 恢复后重新缓存
+	fail.Store(false)
+	missing.Store(false)
+	if v, err := gee.Get("Tom"); err != nil || v.String() != "630" {
+		t.Fatalf("bad value %v, err %v", v, err)
+	}
+}
+
+func TestGetterWithTTL(t *testing.T) {
+	loads := make(map[string]int)
+	gee := NewGroup("ttl", 0, time.Hour, GetterWithTTLFunc(
+		func(ctx context.Context, key string) ([]byte, time.Duration, error) {
+			loads[key]++
+			if key == "config" {
+				return []byte("on"), 20 * time.Millisecond, nil
+			}
+			return []byte(key), 0, nil
+		}))
+
+	gee.Get("config")
+	gee.Get("user")
+	time.Sleep(30 * time.Millisecond)
+	gee.Get("config")
+	gee.Get("user")
+	if loads["config"] != 2 || loads["user"] != 1 {
+		t.Fatalf("config should expire on its own ttl: %v", loads)
+	}
+}
+
+func TestExpireJitter(t *testing.T) {
+	gee := NewGroupWithOptions("jitter", GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}),
+		WithExpire(time.Minute),
+		WithExpireJitter(0.5))
+
+	start := time.Now()
+	expires := make(map[time.Duration]bool)
+	for i := 0; i < 20; i++ {
+		key := strconv.Itoa(i)
+		gee.Get(key)
+		_, expire, ok := gee.mainCache.getWithExpire(key)
+		if !ok {
+			t.Fatalf("%s should be cached", key)
+		}
+		ttl := expire.Sub(start)
+		if ttl < time.Minute || ttl > 90*time.Second+time.Second {
+			t.Fatalf("ttl %v out of range", ttl)
+		}
+		expires[ttl.Truncate(time.Millisecond)] = true
+	}
+	if len(expires) < 10 {
+		t.Fatalf("ttl should be randomized, got %d distinct values", len(expires))
+	}
+}
+
+func TestCompression(t *testing.T) {
+	big := []byte(strings.Repeat(`{"name":"Tom","score":630},`, 100))
+	gee := NewGroupWithOptions("compress", GetterFunc(
+		func(key string) ([]byte, error) {
+			if key == "big" {
+				return big, nil
+			}
+			return []byte(key), nil
+		}),
+		WithCompression(Gzip, 64))
+
+	for i := 0; i < 2; i++ {
+		v, err := gee.Get("big")
+		if err != nil || !bytes.Equal(v.ByteSlice(), big) {
+			t.Fatalf("bad value, err %v", err)
+		}
+		// 版本按压缩前的内容计算
+		if v.Version() != valueVersion(big) {
+			t.Fatalf("bad version %d", v.Version())
+		}
+	}
+	if cs := gee.CacheStats(); cs.Hits != 1 || cs.Bytes >= int64(len(big))/5 {
+		t.Fatalf("big value should be stored compressed: %+v", cs)
+	}
+
+	// 小于阈值的值不压缩
+	before := gee.CacheStats().Bytes
+	if v, _ := gee.Get("small"); v.String() != "small" {
+		t.Fatalf("bad value %s", v)
+	}
+	if n := gee.CacheStats().Bytes - before; n != int64(len("small")*2) {
+		t.Fatalf("small value should be stored as is, %d bytes", n)
+	}
+}
+
+func TestGzipLevel(t *testing.T) {
+	if _, err := NewGzipCodec(10); err == nil {
+		t.Fatal("invalid level should be rejected")
+	}
+	c, err := NewGzipCodec(gzip.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := []byte(strings.Repeat("geecache", 100))
+	b, err := c.Encode(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err := c.Decode(b); err != nil || !bytes.Equal(d, src) {
+		t.Fatalf("bad round trip, err %v", err)
+	}
+}
+
+// lockCheckCodec 压缩时检查缓存的锁有没有被持有
+type lockCheckCodec struct {
+	Codec
+	mu     *sync.Mutex
+	locked bool
+}
+
+func (c *lockCheckCodec) Encode(src []byte) ([]byte, error) {
+	if c.mu.TryLock() {
+		c.mu.Unlock()
+	} else {
+		c.locked = true
+	}
+	return c.Codec.Encode(src)
+}
+
+// 压缩在加锁之前完成，不阻塞其他读写
+func TestCompressUnlocked(t *testing.T) {
+	codec := &lockCheckCodec{Codec: Gzip}
+	gee := NewGroupWithOptions("compress-unlocked", GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(strings.Repeat(key, 100)), nil
+		}),
+		WithCompression(codec, 64))
+	codec.mu = &gee.mainCache.mu
+	if v, err := gee.Get("Tom"); err != nil || v.String() != strings.Repeat("Tom", 100) {
+		t.Fatalf("bad value %s, err %v", v, err)
+	}
+	if codec.locked {
+		t.Fatal("value should be compressed before taking the cache lock")
+	}
+}
+
+func TestRPCCompression(t *testing.T) {
+	if _, err := NewServer(freeAddr(t), WithStaticPeers(), WithRPCCompression("no-such-codec")); err == nil {
+		t.Fatal("unregistered compressor should be rejected")
+	}
+
+	big := strings.Repeat("geecache", 1000)
+	NewGroupWithOptions("rpc-compress", GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(big), nil
+		}))
+	addr := freeAddr(t)
+	svr, err := NewServer(addr, WithStaticPeers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go svr.Start()
+	defer svr.Stop()
+	waitListening(t, addr)
+
+	local, err := NewServer(freeAddr(t), WithStaticPeers(), WithRPCCompression("gzip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.conns.Close()
+	local.SetPeers(addr)
+	peer, _ := local.Pick("Tom")
+	v, err := peer.Fetch(context.Background(), "rpc-compress", "Tom")
+	if err != nil || string(v) != big {
+		t.Fatalf("fetch with gzip: %v", err)
+	}
+	values, _, err := peer.(BatchFetcher).BatchFetch(context.Background(), "rpc-compress", []string{"Jack"})
+	if err != nil || string(values["Jack"].Value) != big {
+		t.Fatalf("batch fetch with gzip: %v", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	gee := NewGroup("metrics", 2<<10, time.Minute, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}))
+	gee.Get("Tom")
+	gee.Get("Tom")
+
+	svr, err := NewServer("localhost:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.metrics.observeRPC("Get", "OK", 20*time.Millisecond)
+	svr.metrics.peerError("localhost:9998")
+
+	w := httptest.NewRecorder()
+	svr.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, line := range []string{
+		`geecache_gets_total{group="metrics"} 2`,
+		`geecache_hits_total{group="metrics"} 1`,
+		`geecache_cache_items{group="metrics",cache="main"} 1`,
+		`geecache_grpc_server_handling_seconds_bucket{method="Get",code="OK",le="0.01"} 0`,
+		`geecache_grpc_server_handling_seconds_bucket{method="Get",code="OK",le="0.025"} 1`,
+		`geecache_grpc_server_handling_seconds_count{method="Get",code="OK"} 1`,
+		`geecache_peer_fetch_errors_total{peer="localhost:9998"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics should contain %s", line)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf strings.Builder
+	logger := NewSlogLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	gee := NewGroupWithOptions("logger", GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}), WithLogger(logger))
+	gee.Get("Tom")
+	gee.Get("Tom")
+
+	out := buf.String()
+	if !strings.Contains(out, `level=DEBUG msg="cache hit" group=logger key=Tom`) {
+		t.Fatalf("unexpected log output: %q", out)
+	}
+
+	// 默认不输出日志
+	quiet := NewGroupWithOptions("quiet", GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}))
+	if _, ok := quiet.logger.(nopLogger); !ok {
+		t.Fatalf("default logger should be quiet, got %T", quiet.logger)
+	}
+}
+
+// 返回给远程节点的过期时间随值一起取出，值没有留在缓存里时也有
+func TestResponseExpire(t *testing.T) {
+	gee := NewGroupWithOptions("response-expire", GetterWithTTLFunc(
+		func(ctx context.Context, key string) ([]byte, time.Duration, error) {
+			return []byte(strings.Repeat(key, 10)), time.Minute, nil
+		}),
+		WithCacheBytes(8))
+	v, err := gee.Get("Tom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gee.CacheStats().Items != 0 {
+		t.Fatal("value should not fit in the cache")
+	}
+	resp := &pb.Response{}
+	fillResponse(resp, v)
+	if remain := time.Until(millisToExpire(resp.Expire)); remain <= 0 || remain > time.Minute {
+		t.Fatalf("bad expire %v", remain)
+	}
+	if resp.Version != valueVersion([]byte(strings.Repeat("Tom", 10))) {
+		t.Fatalf("bad version %d", resp.Version)
+	}
+}
+
+// Set的ttl经过gRPC传给负责节点，NoExpiration和不足1毫秒的ttl不会变成缓存池的过期时间
+func TestSetTTLOverRPC(t *testing.T) {
+	addr := freeAddr(t)
+	gee := NewGroupWithOptions("set-ttl", GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}),
+		WithExpire(time.Hour))
+	svr, err := NewServer(addr, WithStaticPeers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go svr.Start()
+	defer svr.Stop()
+	waitListening(t, addr)
+
+	local, err := NewServer(freeAddr(t), WithStaticPeers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.conns.Close()
+	local.SetPeers(addr)
+	peer, _ := local.Pick("Tom")
+	w := peer.(WritableFetcher)
+
+	if err := w.Set(context.Background(), "set-ttl", "Tom", []byte("630"), NoExpiration); err != nil {
+		t.Fatal(err)
+	}
+	if _, expire, ok := gee.mainCache.getWithExpire("Tom"); !ok || !expire.IsZero() {
+		t.Fatalf("Tom should never expire, expire %v", expire)
+	}
+	if err := w.Set(context.Background(), "set-ttl", "Jack", []byte("589"), 500*time.Microsecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := gee.mainCache.get("Jack"); ok {
+		t.Fatal("Jack should expire in 1ms, not with the group")
+	}
+}
+
+// 静态节点模式不依赖etcd，client直接连接SetPeers的地址
+func TestStaticPeers(t *testing.T) {
+	addr := freeAddr(t)
+	NewGroupWithOptions("static", GetterFunc(
+		func(key string) ([]byte, error) {
+			if key == "missing" {
+				return nil, ErrNotFound
+			}
+			return []byte("v-" + key), nil
+		}))
+	svr, err := NewServer(addr, WithStaticPeers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- svr.Start() }()
+	waitListening(t, addr)
+
+	local, err := NewServer(freeAddr(t), WithStaticPeers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.SetPeers(addr)
+	peer, ok := local.Pick("Tom")
+	if !ok {
+		t.Fatal("should pick the remote peer")
+	}
+	v, err := peer.(EntryFetcher).FetchEntry(context.Background(), "static", "Tom")
+	if err != nil || string(v.Value) != "v-Tom" {
+		t.Fatalf("fetch from static peer: %q, %v", v.Value, err)
+	}
+	// 过期时间和版本随值一起传回来
+	if remain := time.Until(v.Expire); remain <= 0 || remain > defaultExpiration {
+		t.Fatalf("bad expire %v", v.Expire)
+	}
+	if v.Version != valueVersion([]byte("v-Tom")) {
+		t.Fatalf("bad version %d", v.Version)
+	}
+	values, errs, err := peer.(BatchFetcher).BatchFetch(context.Background(), "static", []string{"Tom", "Jack", "missing"})
+	if err != nil || values["Tom"].Version != v.Version || !values["Tom"].Expire.Equal(v.Expire) {
+		t.Fatalf("bad batch fetch %+v, %v", values, err)
+	}
+	if !errors.Is(errs["missing"], ErrNotFound) {
+		t.Fatalf("batch fetch should keep ErrNotFound: %v", errs["missing"])
+	}
+	if values["Jack"].Expire.IsZero() || values["Jack"].Version == 0 {
+		t.Fatalf("batch fetch should carry expire and version: %+v", values["Jack"])
+	}
+	// 版本没有变化时只返回过期时间
+	cf := peer.(ConditionalFetcher)
+	e, err := cf.FetchIfChanged(context.Background(), "static", "Tom", v.Version)
+	if err != nil || !e.NotModified || len(e.Value) != 0 || e.Expire.IsZero() {
+		t.Fatalf("should be not modified: %+v, %v", e, err)
+	}
+	e, err = cf.FetchIfChanged(context.Background(), "static", "Tom", v.Version+1)
+	if err != nil || e.NotModified || string(e.Value) != "v-Tom" {
+		t.Fatalf("should return the value: %+v, %v", e, err)
+	}
+	// 缓存池不存在时所有接口返回同样的状态码
+	w := peer.(WritableFetcher)
+	if err := w.Set(context.Background(), "no-such-group", "Tom", []byte("630"), 0); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("bad Set error: %v", err)
+	}
+	if err := w.Delete(context.Background(), "no-such-group", "Tom", false); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("bad Delete error: %v", err)
+	}
+	if _, _, err := peer.(BatchFetcher).BatchFetch(context.Background(), "no-such-group", []string{"Tom"}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("bad BatchFetch error: %v", err)
+	}
+	// 远程节点的ErrNotFound通过gRPC状态码传回来
+	if _, err := peer.Fetch(context.Background(), "static", "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("should be ErrNotFound: %v", err)
+	}
+
+	svr.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Start should return after Stop")
+	}
+}
+
+// 返回一个空闲的本地地址
+func freeAddr(t *testing.T) string {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	return fmt.Sprintf("localhost:%d", lis.Addr().(*net.TCPAddr).Port)
+}
+
+func waitListening(t *testing.T, addr string) {
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s is not listening", addr)
+}
+
+func TestRegistryConfig(t *testing.T) {
+	// 零值使用默认配置
+	cfg, err := RegistryConfig{}.EtcdConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.Endpoints, []string{"localhost:2379"}) || cfg.DialTimeout != 5*time.Second || cfg.TLS != nil {
+		t.Fatalf("unexpected default etcd config: %+v", cfg)
+	}
+
+	rc := RegistryConfig{
+		Endpoints: []string{"etcd-0:2379", "etcd-1:2379"},
+		Username:  "gee",
+		Password:  "secret",
+		Prefix:    "cache/",
+	}
+	cfg, err = rc.EtcdConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Endpoints) != 2 || cfg.Username != "gee" || cfg.Password != "secret" {
+		t.Fatalf("unexpected etcd config: %+v", cfg)
+	}
+	if name := rc.ServiceName("localhost:9999"); name != "cache/localhost:9999" {
+		t.Fatalf("bad service name: %s", name)
+	}
+
+	// 证书文件不存在时返回错误
+	if _, err := (RegistryConfig{CAFile: "/nonexistent/ca.pem"}).EtcdConfig(); err == nil {
+		t.Fatal("missing CA file should fail")
+	}
+
+	// server创建的client使用同一个配置
+	svr, err := NewServer("localhost:9999", WithRegistry(rc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.SetPeers("localhost:9998")
+	c := svr.clients["localhost:9998"]
+	if c.name != "cache/localhost:9998" || c.conns != svr.conns || !reflect.DeepEqual(svr.registry, rc) {
+		t.Fatalf("client should use the server registry config: %+v", c)
+	}
+}
+
+// 节点列表变化时只增删变化的节点，保留其他节点的client
+func TestUpdatePeers(t *testing.T) {
+	svr, err := NewServer("localhost:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := svr.Pick("Tom"); ok {
+		t.Fatal("should pick nothing before peers are known")
+	}
+
+	svr.updatePeers([]string{"localhost:9999", "localhost:9998", "localhost:9997"})
+	kept := svr.clients["localhost:9998"]
+	svr.updatePeers([]string{"localhost:9999", "localhost:9998", "localhost:9996", "bad-addr"})
+
+	if len(svr.clients) != 3 || svr.clients["localhost:9997"] != nil || svr.clients["localhost:9996"] == nil {
+		t.Fatalf("unexpected clients: %v", svr.clients)
+	}
+	if svr.clients["localhost:9998"] != kept {
+		t.Fatal("client of an unchanged peer should be kept")
+	}
+	for i := 0; i < 100; i++ {
+		if peer, ok := svr.Pick(fmt.Sprint(i)); ok && peer.(*client).addr == "localhost:9997" {
+			t.Fatal("removed peer should not be picked")
+		}
+	}
+}
+
+// Shutdown 等待正在处理的请求完成，然后Start返回nil
+func TestShutdown(t *testing.T) {
+	addr := freeAddr(t)
+	started := make(chan struct{})
+	NewGroupWithOptions("shutdown", GetterFunc(
+		func(key string) ([]byte, error) {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+			return []byte(key), nil
+		}))
+	svr, err := NewServer(addr, WithStaticPeers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- svr.Start() }()
+	waitListening(t, addr)
+
+	local, err := NewServer(freeAddr(t), WithStaticPeers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.SetPeers(addr)
+	peer, _ := local.Pick("Tom")
+	fetched := make(chan error, 1)
+	go func() {
+		_, err := peer.Fetch(context.Background(), "shutdown", "Tom")
+		fetched <- err
+	}()
+
+	<-started
+	if err := svr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-fetched; err != nil {
+		t.Fatalf("in-flight request should complete: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Start should return nil after Shutdown: %v", err)
+	}
+	// 再次调用是no-op
+	if err := svr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := local.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// slowDiscovery Register一直阻塞到release关闭
+type slowDiscovery struct {
+	registering chan struct{}
+	release     chan struct{}
+	closed      bool
+}
+
+func (d *slowDiscovery) Close() error {
+	d.closed = true
+	return nil
+}
+
+func (d *slowDiscovery) Register(ctx context.Context, addr string) error {
+	close(d.registering)
+	<-d.release
+	return nil
+}
+
+func (d *slowDiscovery) Deregister(ctx context.Context, addr string) error { return nil }
+
+func (d *slowDiscovery) Watch(ctx context.Context, update func(addrs []string)) error {
+	<-ctx.Done()
+	return nil
+}
+
+// Start注册期间不持有锁，Pick不会被阻塞，重复Start返回错误
+func TestStartRegisterUnlocked(t *testing.T) {
+	d := &slowDiscovery{registering: make(chan struct{}), release: make(chan struct{})}
+	addr := freeAddr(t)
+	svr, err := NewServer(addr, WithDiscovery(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.SetPeers(addr, "localhost:9998")
+	done := make(chan error, 1)
+	go func() { done <- svr.Start() }()
+	<-d.registering
+
+	picked := make(chan struct{})
+	go func() {
+		svr.Pick("Tom")
+		close(picked)
+	}()
+	select {
+	case <-picked:
+	case <-time.After(time.Second):
+		t.Fatal("Pick should not be blocked by Register")
+	}
+	if err := svr.Start(); err == nil {
+		t.Fatal("second Start should fail")
+	}
+
+	// 注册期间Shutdown等Start完成再停止，Start不会一直运行
+	stopped := make(chan error, 1)
+	go func() { stopped <- svr.Shutdown(context.Background()) }()
+	select {
+	case <-stopped:
+		t.Fatal("Shutdown should wait for Start")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(d.release)
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Start should return after Shutdown")
+	}
+	// WithDiscovery传入的服务发现由调用方关闭
+	if d.closed {
+		t.Fatal("discovery passed in should not be closed by the server")
+	}
+}
+
+// 同一个节点共用一个连接，节点离开后关闭自己创建的连接，共用的连接不关闭
+func TestConnManager(t *testing.T) {
+	m := NewConnManager(nil)
+	svr, err := NewServer("localhost:9999", WithStaticPeers(), WithConnManager(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.SetPeers("localhost:9999", "localhost:9998", "localhost:9997")
+
+	a, err := m.stub("localhost:9998", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := svr.clients["localhost:9998"].conns.stub("localhost:9998", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Fatal("stub of the same peer should be reused")
+	}
+	conn := m.peers["localhost:9998"].conn
+
+	// 共用的连接可能还有其他server在用，节点离开时不关闭
+	svr.updatePeers([]string{"localhost:9999", "localhost:9997"})
+	if _, ok := m.peers["localhost:9998"]; !ok {
+		t.Fatal("shared connection should not be closed by the server")
+	}
+	if state := conn.GetState().String(); state == "SHUTDOWN" {
+		t.Fatalf("bad connection state: %s", state)
+	}
+
+	// 自己创建的连接，节点离开哈希环时关闭
+	own, err := NewServer("localhost:9996", WithStaticPeers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	own.SetPeers("localhost:9996", "localhost:9998")
+	if _, err := own.conns.stub("localhost:9998", ""); err != nil {
+		t.Fatal(err)
+	}
+	ownConn := own.conns.peers["localhost:9998"].conn
+	own.updatePeers([]string{"localhost:9996"})
+	if _, ok := own.conns.peers["localhost:9998"]; ok {
+		t.Fatal("connection of the removed peer should be closed")
+	}
+	if state := ownConn.GetState().String(); state != "SHUTDOWN" {
+		t.Fatalf("bad connection state: %s", state)
+	}
+	own.conns.Close()
+
+	m.stub("localhost:9997", "")
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.peers) != 0 {
+		t.Fatal("Close should close all connections")
+	}
+	if state := conn.GetState().String(); state != "SHUTDOWN" {
+		t.Fatalf("bad connection state: %s", state)
+	}
+
+	// NewClient创建的client自己持有连接，Close时关闭
+	c := NewClient("localhost:9998")
+	direct := NewConnManager(nil)
+	if _, err := direct.stub("localhost:9998", ""); err != nil {
+		t.Fatal(err)
+	}
+	c.conns.peers["localhost:9998"] = direct.peers["localhost:9998"]
+	clientConn := direct.peers["localhost:9998"].conn
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.conns.peers) != 0 || c.etcd != nil {
+		t.Fatal("Close should release the connections and etcd client")
+	}
+	if state := clientConn.GetState().String(); state != "SHUTDOWN" {
+		t.Fatalf("bad connection state: %s", state)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// funcPeer Fetch由函数实现，其他方法和fakePeer一样
+type funcPeer struct {
+	fakePeer
+	fetch func(ctx context.Context, key string) ([]byte, error)
+}
+
+func (p *funcPeer) Pick(key string) (Fetcher, bool) {
+	return p, true
+}
+
+func (p *funcPeer) Fetch(ctx context.Context, group string, key string) ([]byte, error) {
+	return p.fetch(ctx, key)
+}
+
+func (p *funcPeer) FetchEntry(ctx context.Context, group string, key string) (Entry, error) {
+	v, err := p.fetch(ctx, key)
+	return Entry{Value: v}, err
+}
+
+// ringPeer 所有key都由primary负责，下一个节点是successor
+type ringPeer struct {
+	primary, successor Fetcher
+}
+
+func (p *ringPeer) Pick(key string) (Fetcher, bool) {
+	return p.primary, true
+}
+
+func (p *ringPeer) Peers() []Fetcher {
+	return []Fetcher{p.primary, p.successor}
+}
+
+func (p *ringPeer) Successor(key string) (Fetcher, bool) {
+	return p.successor, true
+}
+
+func TestFetchPolicy(t *testing.T) {
+	var loads int
+	getter := GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte("local"), nil
+	})
+
+	// 可重试的错误按策略重试
+	failures := 2
+	flaky := &funcPeer{fetch: func(ctx context.Context, key string) ([]byte, error) {
+		if failures > 0 {
+			failures--
+			return nil, status.Error(codes.Unavailable, "connection refused")
+		}
+		return []byte("remote"), nil
+	}}
+	g := NewGroupWithOptions("retry", getter, WithPeers(flaky),
+		WithFetchPolicy(FetchPolicy{Retries: 2, Backoff: time.Millisecond}))
+	if v, err := g.Get("Tom"); err != nil || v.String() != "remote" {
+		t.Fatalf("retry should succeed: %v, %v", v, err)
+	}
+	if s := g.Stats(); s.PeerRetries != 2 || loads != 0 {
+		t.Fatalf("bad retries %d, loads %d", s.PeerRetries, loads)
+	}
+
+	// 负责的节点确认不存在，不重试也不回退
+	fetches := 0
+	missing := &funcPeer{fetch: func(ctx context.Context, key string) ([]byte, error) {
+		fetches++
+		return nil, status.Error(codes.NotFound, "no such key")
+	}}
+	g = NewGroupWithOptions("notfound", getter, WithPeers(missing), WithFetchPolicy(FetchPolicy{Retries: 3}))
+	if _, err := g.Get("Tom"); err == nil || fetches != 1 || loads != 0 {
+		t.Fatalf("not found should fail once without fallback: %v, fetches %d, loads %d", err, fetches, loads)
+	}
+
+	// 其他错误默认回退到本地，FailFast时直接返回错误
+	broken := &funcPeer{fetch: func(ctx context.Context, key string) ([]byte, error) {
+		return nil, status.Error(codes.Internal, "boom")
+	}}
+	g = NewGroupWithOptions("fallback", getter, WithPeers(broken))
+	if v, err := g.Get("Tom"); err != nil || v.String() != "local" || loads != 1 {
+		t.Fatalf("should fall back to local: %v, %v", v, err)
+	}
+	g = NewGroupWithOptions("failfast", getter, WithPeers(broken), WithFetchPolicy(FetchPolicy{FailFast: true}))
+	if _, err := g.Get("Tom"); status.Code(err) != codes.Internal {
+		t.Fatalf("fail fast should return the peer error: %v", err)
+	}
+	if loads != 1 {
+		t.Fatalf("fail fast should not load locally, loads %d", loads)
+	}
+}
+
+// 负责的节点太慢时向下一个节点发对冲请求
+func TestHedgedFetch(t *testing.T) {
+	slow := &funcPeer{fetch: func(ctx context.Context, key string) ([]byte, error) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+			return []byte("slow"), nil
+		}
+	}}
+	fast := &funcPeer{fetch: func(ctx context.Context, key string) ([]byte, error) {
+		if !isLocalOnly(ctx) {
+			return nil, fmt.Errorf("hedged request should be local only")
+		}
+		return []byte("fast"), nil
+	}}
+	g := NewGroupWithOptions("hedge", GetterFunc(
+		func(key string) ([]byte, error) {
+			return nil, fmt.Errorf("%s should be loaded from peer", key)
+		}),
+		WithPeers(&ringPeer{primary: slow, successor: fast}),
+		WithFetchPolicy(FetchPolicy{HedgeAfter: 20 * time.Millisecond}))
+
+	start := time.Now()
+	v, err := g.Get("Tom")
+	if err != nil || v.String() != "fast" {
+		t.Fatalf("hedged fetch should win: %v, %v", v, err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("hedged fetch took %v", d)
+	}
+	if s := g.Stats(); s.PeerHedges != 1 {
+		t.Fatalf("bad hedges: %d", s.PeerHedges)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker(BreakerConfig{Failures: 2, OpenTimeout: 20 * time.Millisecond})
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+
+	// key不存在不算失败
+	b.record(context.Background(), status.Error(codes.NotFound, "no such key"))
+	b.record(context.Background(), unavailable)
+	if state, failures, _ := b.stats(); state != BreakerClosed || failures != 1 {
+		t.Fatalf("bad state %v, failures %d", state, failures)
+	}
+	b.record(context.Background(), unavailable)
+	if err := b.allow(); !errors.Is(err, ErrBreakerOpen) || b.ready() {
+		t.Fatalf("breaker should be open: %v", err)
+	}
+
+	// 打开超时后只放一个探测请求
+	time.Sleep(30 * time.Millisecond)
+	if state, _, _ := b.stats(); state != BreakerHalfOpen {
+		t.Fatalf("bad state %v", state)
+	}
+	if err := b.allow(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.allow(); !errors.Is(err, ErrBreakerOpen) {
+		t.Fatal("only one probe should be allowed")
+	}
+	// 探测失败重新打开
+	b.record(context.Background(), unavailable)
+	if state, _, opens := b.stats(); state != BreakerOpen || opens != 2 {
+		t.Fatalf("bad state %v, opens %d", state, opens)
+	}
+	time.Sleep(30 * time.Millisecond)
+	b.allow()
+	b.record(context.Background(), nil)
+	if state, failures, _ := b.stats(); state != BreakerClosed || failures != 0 {
+		t.Fatalf("probe succeeded, bad state %v, failures %d", state, failures)
+	}
+
+	// 取消的请求不改变状态，探测请求被取消后可以重新探测
+	b.record(context.Background(), unavailable)
+	b.record(context.Background(), status.Error(codes.Canceled, "hedge won"))
+	b.record(context.Background(), context.Canceled)
+	if state, failures, _ := b.stats(); state != BreakerClosed || failures != 1 {
+		t.Fatalf("canceled calls should not reset failures, state %v, failures %d", state, failures)
+	}
+	b.record(context.Background(), unavailable)
+	time.Sleep(30 * time.Millisecond)
+	if err := b.allow(); err != nil {
+		t.Fatal(err)
+	}
+	b.record(context.Background(), context.Canceled)
+	if state, _, _ := b.stats(); state != BreakerHalfOpen {
+		t.Fatalf("abandoned probe should not close the breaker, state %v", state)
+	}
+	if err := b.allow(); err != nil {
+		t.Fatalf("should allow a new probe: %v", err)
+	}
+
+	if newBreaker(BreakerConfig{Disabled: true}) != nil {
+		t.Fatal("disabled breaker should be nil")
+	}
+}
+
+// 调用方自己的超时不算节点失败，正常的节点不会被熔断
+func TestBreakerCallerDeadline(t *testing.T) {
+	addr := freeAddr(t)
+	NewGroupWithOptions("breaker-deadline", GetterFunc(
+		func(key string) ([]byte, error) {
+			time.Sleep(50 * time.Millisecond)
+			return []byte(key), nil
+		}))
+	svr, err := NewServer(addr, WithStaticPeers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go svr.Start()
+	defer svr.Stop()
+	waitListening(t, addr)
+
+	local, err := NewServer(freeAddr(t), WithStaticPeers(),
+		WithCircuitBreaker(BreakerConfig{Failures: 2, OpenTimeout: time.Minute}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.conns.Close()
+	local.SetPeers(addr)
+	peer, _ := local.Pick("Tom")
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		_, err := peer.Fetch(ctx, "breaker-deadline", strconv.Itoa(i))
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) && status.Code(err) != codes.DeadlineExceeded {
+			t.Fatalf("should time out: %v", err)
+		}
+	}
+	if stats := local.PeerStats(); len(stats) != 1 || stats[0].Breaker != BreakerClosed {
+		t.Fatalf("caller deadlines should not open the breaker: %+v", stats)
+	}
+}
+
+// 远程节点挂了，熔断器打开后从本地获取
+func TestBreakerPick(t *testing.T) {
+	dead := freeAddr(t)
+	svr, err := NewServer(freeAddr(t), WithStaticPeers(),
+		WithCircuitBreaker(BreakerConfig{Failures: 2, OpenTimeout: time.Minute}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.SetPeers(dead)
+	for i := 0; i < 2; i++ {
+		peer, ok := svr.Pick("Tom")
+		if !ok {
+			t.Fatal("should pick the peer before the breaker opens")
+		}
+		if _, err := peer.Fetch(context.Background(), "breaker", "Tom"); err == nil {
+			t.Fatal("fetch from a dead peer should fail")
+		}
+	}
+	if _, ok := svr.Pick("Tom"); ok {
+		t.Fatal("should load locally while the breaker is open")
+	}
+	// 写入和删除不能因为熔断落到不负责的节点
+	gee := NewGroupWithOptions("breaker-set", GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}),
+		WithPeers(svr))
+	if err := gee.Set("Tom", []byte("630"), 0); !errors.Is(err, ErrBreakerOpen) {
+		t.Fatalf("Set should be rejected by the owner's breaker: %v", err)
+	}
+	if _, ok := gee.mainCache.get("Tom"); ok {
+		t.Fatal("Tom should not be written to a non-owner")
+	}
+	if err := gee.Remove("Tom"); !errors.Is(err, ErrBreakerOpen) {
+		t.Fatalf("Remove should be rejected by the owner's breaker: %v", err)
+	}
+	stats := svr.PeerStats()
+	if len(stats) != 1 || stats[0].Addr != dead || stats[0].Breaker != BreakerOpen || stats[0].Opens != 1 {
+		t.Fatalf("bad peer stats: %+v", stats)
+	}
+
+	w := httptest.NewRecorder()
+	svr.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if line := fmt.Sprintf("geecache_peer_circuit_breaker_state{peer=%q} 1\n", dead); !strings.Contains(w.Body.String(), line) {
+		t.Fatalf("metrics should contain %s", line)
+	}
+	svr.conns.Close()
+}
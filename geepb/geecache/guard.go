@@ -0,0 +1,83 @@
+package geecache
+
+import (
+	"fmt"
+	"geecache/bloom"
+	"sync/atomic"
+)
+
+// 布隆过滤器：缓存没有命中时先查过滤器，一定不存在的key直接返回ErrNotFound，
+// 不经过singleflight、远程节点和Getter。只有应用给出的过滤器(写入了所有存在的key、
+// 重建或者从快照加载)才拦截，学习模式下记录加载成功和Set的key，学到的过滤器不完整，只学习不拦截。
+// Set的key总是加入过滤器，负责节点清除其他节点副本时，收到的节点也把key加入自己的过滤器
+
+// bloomGuard Group中过滤器的状态
+type bloomGuard struct {
+	// 当前的过滤器，为nil时不拦截，重建时整个替换
+	filter atomic.Pointer[bloom.Filter]
+	// 学习模式，加载成功和Set的key加入过滤器
+	learn bool
+	// 过滤器包含所有存在的key，可以拦截，只学习得到的过滤器不拦截
+	authoritative atomic.Bool
+}
+
+// BloomFilter 返回当前的过滤器，可以用WriteTo保存快照，没有开启时返回nil
+func (g *Group) BloomFilter() *bloom.Filter {
+	return g.guard.filter.Load()
+}
+
+// SetBloomFilter 替换过滤器，比如启动时加载的快照，f应该包含所有存在的key，为nil时关闭拦截
+func (g *Group) SetBloomFilter(f *bloom.Filter) {
+	g.guard.filter.Store(f)
+	g.guard.authoritative.Store(f != nil)
+}
+
+// RebuildBloomFilter 用所有存在的key重建过滤器，大小和当前的一样
+// 重建期间仍然用旧的过滤器，建好后整个替换，已经删除的key不再放行
+func (g *Group) RebuildBloomFilter(keys []string) {
+	var f *bloom.Filter
+	if old := g.guard.filter.Load(); old != nil {
+		f = old.Empty()
+		for _, key := range keys {
+			f.Add(key)
+		}
+	} else {
+		f = bloom.FromKeys(keys, defaultBloomFP)
+	}
+	g.SetBloomFilter(f)
+}
+
+// 没有指定大小时过滤器的误判率
+const defaultBloomFP = 0.01
+
+// rejectByBloom 过滤器判断key一定不存在时返回错误
+func (g *Group) rejectByBloom(key string) error {
+	if !g.guard.authoritative.Load() {
+		return nil
+	}
+	f := g.guard.filter.Load()
+	if f == nil || f.Test(key) {
+		return nil
+	}
+	g.stats.bloomRejects.Add(1)
+	g.logger.Debug("rejected by bloom filter", "group", g.name, "key", key)
+	return fmt.Errorf("%w: %s/%s rejected by bloom filter", ErrNotFound, g.name, key)
+}
+
+// addKey 记录Set写入的key，只要有过滤器就加入，不管是不是学习模式
+// 否则应用给出的过滤器会把新写入的key当作不存在拦截
+func (g *Group) addKey(key string) {
+	if f := g.guard.filter.Load(); f != nil {
+		f.Add(key)
+	}
+}
+
+// learnKey 学习模式下记录一个存在的key
+func (g *Group) learnKey(key string) {
+	if !g.guard.learn {
+		return
+	}
+	if f := g.guard.filter.Load(); f != nil {
+		f.Add(key)
+	}
+}
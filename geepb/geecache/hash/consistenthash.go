@@ -47,6 +47,24 @@ func (m *Map) Add(keys ...string) {
 	sort.Ints(m.keys)
 }
 
+// 删除节点及其所有虚拟节点
+func (m *Map) Remove(keys ...string) {
+	for _, key := range keys {
+		for i := 0; i < m.replicas; i++ {
+			hashkey := int(m.hash([]byte(strconv.Itoa(i) + key)))
+			// 虚拟节点哈希冲突时只删除属于自己的
+			if m.hashMap[hashkey] == key {
+				delete(m.hashMap, hashkey)
+			}
+		}
+	}
+	m.keys = m.keys[:0]
+	for hashkey := range m.hashMap {
+		m.keys = append(m.keys, hashkey)
+	}
+	sort.Ints(m.keys)
+}
+
 // 选择节点的get
 func (m *Map) Get(key string) string {
 	if len(m.keys) == 0 {
@@ -60,3 +78,24 @@ func (m *Map) Get(key string) string {
 	return m.hashMap[m.keys[idx%len(m.keys)]]
 
 }
+
+// GetN 从key的位置开始顺时针选出最多n个不同的真实节点，第一个和Get相同
+func (m *Map) GetN(key string, n int) []string {
+	if len(m.keys) == 0 || n <= 0 {
+		return nil
+	}
+	hash := int(m.hash([]byte(key)))
+	idx := sort.Search(len(m.keys), func(i int) bool {
+		return m.keys[i] >= hash
+	})
+	nodes := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; i < len(m.keys) && len(nodes) < n; i++ {
+		node := m.hashMap[m.keys[(idx+i)%len(m.keys)]]
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
@@ -1,6 +1,7 @@
 package consistenthash
 
 import (
+	"reflect"
 	"strconv"
 	"testing"
 )
@@ -34,3 +35,45 @@ func TestHashing(t *testing.T) {
 	// }
 
 }
+
+func TestRemove(t *testing.T) {
+	hash := New(3, func(data []byte) uint32 {
+		i, _ := strconv.Atoi(string(data))
+		return uint32(i)
+	})
+	hash.Add("6", "4", "2")
+	hash.Remove("2")
+	// 原来属于2的key落到下一个节点
+	testCases := map[string]string{
+		"2":  "4",
+		"11": "4",
+		"23": "4",
+		"27": "4",
+		"15": "6",
+	}
+	for k, v := range testCases {
+		if hash.Get(k) != v {
+			t.Errorf("Asking for %s, should have yielded %s", k, v)
+		}
+	}
+
+	hash.Remove("6", "4")
+	if got := hash.Get("27"); got != "" {
+		t.Errorf("empty ring should yield nothing, got %s", got)
+	}
+}
+
+func TestGetN(t *testing.T) {
+	hash := New(3, func(data []byte) uint32 {
+		i, _ := strconv.Atoi(string(data))
+		return uint32(i)
+	})
+	hash.Add("6", "4", "2")
+	// 11落在12(节点2)上，顺时针接下来是14(节点4)、16(节点6)
+	if got := hash.GetN("11", 2); !reflect.DeepEqual(got, []string{"2", "4"}) {
+		t.Errorf("bad successors: %v", got)
+	}
+	if got := hash.GetN("27", 5); !reflect.DeepEqual(got, []string{"2", "4", "6"}) {
+		t.Errorf("should yield every node once: %v", got)
+	}
+}
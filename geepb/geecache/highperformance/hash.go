@@ -157,6 +157,25 @@ func (h *HashLruCache) Remove(key interface{}) (present bool) {
 	return
 }
 
+// RemoveOldest 从条数最多的分片中移除最老的项
+// 分片之间没有全局顺序，这是近似的最老项
+func (h *HashLruCache) RemoveOldest() (key interface{}, value interface{}, expirationTime int64, ok bool) {
+	// 找到条数最多的分片
+	sliceKey, maxLen := 0, -1
+	for i := 0; i < h.sliceNum; i++ {
+		h.list[i].lock.RLock()
+		if l := h.list[i].lru.Len(); l > maxLen {
+			sliceKey, maxLen = i, l
+		}
+		h.list[i].lock.RUnlock()
+	}
+
+	h.list[sliceKey].lock.Lock()
+	key, value, expirationTime, ok = h.list[sliceKey].lru.RemoveOldest()
+	h.list[sliceKey].lock.Unlock()
+	return key, value, expirationTime, ok
+}
+
 // Resize 调整缓存大小，返回调整前的数量
 func (h *HashLruCache) Resize(size int) (evicted int) {
 	if size < h.sliceNum {
@@ -0,0 +1,29 @@
+package geecache
+
+import "log/slog"
+
+// Logger 分级的结构化日志接口，args是成对的key、value，和log/slog一样
+// 例如 logger.Debug("cache hit", "group", name, "key", key)
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// NewSlogLogger 把slog.Logger作为Logger，l为nil时使用slog.Default()
+// 日志级别由slog的Handler控制
+func NewSlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return l
+}
+
+// nopLogger 默认的Logger，什么都不输出
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...any) {}
+func (nopLogger) Info(msg string, args ...any)  {}
+func (nopLogger) Warn(msg string, args ...any)  {}
+func (nopLogger) Error(msg string, args ...any) {}
@@ -82,6 +82,12 @@ func (c *Lru) startCleanupTimer() {
 
 // 新增了，查询节点，如果过期删除
 func (c *Lru) Get(key string) (v Value, ok bool) {
+	v, _, ok = c.GetWithExpire(key)
+	return
+}
+
+// GetWithExpire 和Get一样，同时返回过期的时间点，不过期时为零值
+func (c *Lru) GetWithExpire(key string) (v Value, expire time.Time, ok bool) {
 	if e, ok := c.cache[key]; ok {
 		c.l.MoveToFront(e)
 		//对e。value取出所指得list元素然后断言是entry指针类型
@@ -90,14 +96,27 @@ func (c *Lru) Get(key string) (v Value, ok bool) {
 		if !kv.expire.IsZero() && time.Now().After(kv.expire) {
 			c.removeElement(e)
 
-			return nil, false
+			return nil, time.Time{}, false
 		}
 		//返回entry中得Value类型得v
-		return kv.value, ok
+		return kv.value, kv.expire, ok
 	}
 	return
 }
 
+// PurgeOverdue 删除所有过期的节点，不加锁，由调用方保证并发安全
+func (c *Lru) PurgeOverdue() {
+	now := time.Now()
+	for e := c.l.Back(); e != nil; {
+		prev := e.Prev()
+		kv := e.Value.(*entry)
+		if !kv.expire.IsZero() && now.After(kv.expire) {
+			c.removeElement(e)
+		}
+		e = prev
+	}
+}
+
 func (c *Lru) RemoveOldest() {
 	//指向最后元素得指针
 	e := c.l.Back()
@@ -108,6 +127,15 @@ func (c *Lru) RemoveOldest() {
 
 }
 
+// 删除指定的key，返回是否存在
+func (c *Lru) Remove(key string) bool {
+	if e, ok := c.cache[key]; ok {
+		c.removeElement(e)
+		return true
+	}
+	return false
+}
+
 // 抽象在lru中删除元素，删除l中，map中，大小再-去
 func (c *Lru) removeElement(ele *list.Element) {
 	c.l.Remove(ele)
@@ -151,6 +179,11 @@ func (c *Lru) Len() int {
 	return c.l.Len()
 }
 
+// 已使用的字节数
+func (c *Lru) Bytes() int64 {
+	return c.nbytes
+}
+
 // 新增删除所有节点
 func (c *Lru) Clear() {
 	if c.OnEvicted != nil {
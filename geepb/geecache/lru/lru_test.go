@@ -15,7 +15,7 @@ func (d String) Len() int {
 
 func TestGet(t *testing.T) {
 	lru := New(int64(0), nil)
-	lru.Add("key1", String("1234"))
+	lru.Add("key1", String("1234"), 0)
 	//lru.Add("key1", INt{123,123})
 	if v, ok := lru.Get("key1"); !ok || string(v.(String)) != "1234" {
 		t.Fatalf("cache hit key1=1234 failed")
@@ -31,9 +31,9 @@ func TestRemoveoldest(t *testing.T) {
 	v1, v2, v3 := "value1", "value2", "v3"
 	cap := len(k1 + k2 + v1 + v2)
 	lru := New(int64(cap), nil)
-	lru.Add(k1, String(v1))
-	lru.Add(k2, String(v2))
-	lru.Add(k3, String(v3))
+	lru.Add(k1, String(v1), 0)
+	lru.Add(k2, String(v2), 0)
+	lru.Add(k3, String(v3), 0)
 
 	if _, ok := lru.Get("key1"); ok || lru.Len() != 2 {
 		t.Fatalf("Removeoldest key1 failed")
@@ -45,10 +45,10 @@ func TestOnEvicted(t *testing.T) {
 		keys = append(keys, key)
 	}
 	lru := New(int64(10), callback)
-	lru.Add("key1", String("123456"))
-	lru.Add("k2", String("k2"))
-	lru.Add("k3", String("k3"))
-	lru.Add("k4", String("k4"))
+	lru.Add("key1", String("123456"), 0)
+	lru.Add("k2", String("k2"), 0)
+	lru.Add("k3", String("k3"), 0)
+	lru.Add("k4", String("k4"), 0)
 
 	expect := []string{"key1", "k2"}
 
@@ -0,0 +1,215 @@
+package geecache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// metrics 模块以Prometheus文本格式导出节点的监控指标
+// 缓存池的计数器在抓取时从Group.Stats读取，RPC耗时和远程节点错误由server和client记录
+
+// RPC耗时直方图的桶，单位秒，和Prometheus客户端的默认值一样
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metrics struct {
+	mu sync.Mutex
+	// 按方法名和状态码统计的RPC耗时
+	rpcLatency map[rpcLabels]*histogram
+	// 按远程节点地址统计的获取失败次数
+	peerErrors map[string]int64
+	// 远程节点的熔断器状态，由server设置
+	peerStats func() []PeerStats
+}
+
+type rpcLabels struct {
+	method string
+	code   string
+}
+
+type histogram struct {
+	counts []uint64 // 每个桶的计数，不累加
+	sum    float64
+	count  uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		rpcLatency: make(map[rpcLabels]*histogram),
+		peerErrors: make(map[string]int64),
+	}
+}
+
+// observeRPC 记录一次RPC的耗时
+func (m *metrics) observeRPC(method, code string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	labels := rpcLabels{method, code}
+	h, ok := m.rpcLatency[labels]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.rpcLatency[labels] = h
+	}
+	v := d.Seconds()
+	for i, le := range latencyBuckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// peerError 记录一次从远程节点获取失败
+func (m *metrics) peerError(peer string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.peerErrors[peer]++
+}
+
+// unaryInterceptor gRPC服务端拦截器，记录每个请求的耗时和状态码
+func (m *metrics) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	// FullMethod 形如 /geecachepb.GroupCache/Get，只保留方法名
+	method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+	m.observeRPC(method, status.Code(err).String(), time.Since(start))
+	return resp, err
+}
+
+// ServeHTTP 输出所有指标
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.writeTo(w)
+}
+
+func (m *metrics) writeTo(w io.Writer) {
+	writeGroupMetrics(w)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	labels := make([]rpcLabels, 0, len(m.rpcLatency))
+	for l := range m.rpcLatency {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].method != labels[j].method {
+			return labels[i].method < labels[j].method
+		}
+		return labels[i].code < labels[j].code
+	})
+	writeHeader(w, "geecache_grpc_server_handling_seconds", "histogram", "Latency of gRPC requests handled by this node.")
+	for _, l := range labels {
+		h := m.rpcLatency[l]
+		lbl := fmt.Sprintf("method=\"%s\",code=\"%s\"", escapeLabel(l.method), escapeLabel(l.code))
+		var cum uint64
+		for i, le := range latencyBuckets {
+			cum += h.counts[i]
+			fmt.Fprintf(w, "geecache_grpc_server_handling_seconds_bucket{%s,le=\"%g\"} %d\n", lbl, le, cum)
+		}
+		fmt.Fprintf(w, "geecache_grpc_server_handling_seconds_bucket{%s,le=\"+Inf\"} %d\n", lbl, h.count)
+		fmt.Fprintf(w, "geecache_grpc_server_handling_seconds_sum{%s} %g\n", lbl, h.sum)
+		fmt.Fprintf(w, "geecache_grpc_server_handling_seconds_count{%s} %d\n", lbl, h.count)
+	}
+
+	peers := make([]string, 0, len(m.peerErrors))
+	for p := range m.peerErrors {
+		peers = append(peers, p)
+	}
+	sort.Strings(peers)
+	writeHeader(w, "geecache_peer_fetch_errors_total", "counter", "Failed fetches from each peer.")
+	for _, p := range peers {
+		fmt.Fprintf(w, "geecache_peer_fetch_errors_total{peer=\"%s\"} %d\n", escapeLabel(p), m.peerErrors[p])
+	}
+
+	if m.peerStats == nil {
+		return
+	}
+	stats := m.peerStats()
+	writeHeader(w, "geecache_peer_circuit_breaker_state", "gauge", "Circuit breaker state of each peer: 0 closed, 1 open, 2 half-open.")
+	for _, ps := range stats {
+		fmt.Fprintf(w, "geecache_peer_circuit_breaker_state{peer=\"%s\"} %d\n", escapeLabel(ps.Addr), ps.Breaker)
+	}
+	writeHeader(w, "geecache_peer_circuit_breaker_opens_total", "counter", "Times the circuit breaker of each peer opened.")
+	for _, ps := range stats {
+		fmt.Fprintf(w, "geecache_peer_circuit_breaker_opens_total{peer=\"%s\"} %d\n", escapeLabel(ps.Addr), ps.Opens)
+	}
+}
+
+// 缓存池的指标，每个指标一个名字、类型、说明和取值函数
+var groupMetrics = []struct {
+	name, typ, help string
+	value           func(s Stats) int64
+}{
+	{"geecache_gets_total", "counter", "Get requests, including each key of a batch.", func(s Stats) int64 { return s.Gets }},
+	{"geecache_hits_total", "counter", "Hits in the main or hot cache.", func(s Stats) int64 { return s.Hits }},
+	{"geecache_misses_total", "counter", "Misses in both caches.", func(s Stats) int64 { return s.Misses }},
+	{"geecache_negative_hits_total", "counter", "Lookups answered by the negative cache.", func(s Stats) int64 { return s.NegativeHits }},
+	{"geecache_bloom_rejects_total", "counter", "Lookups rejected by the bloom filter.", func(s Stats) int64 { return s.BloomRejects }},
+	{"geecache_loads_total", "counter", "Loads after a miss.", func(s Stats) int64 { return s.Loads }},
+	{"geecache_loads_deduped_total", "counter", "Loads after singleflight deduplication.", func(s Stats) int64 { return s.LoadsDeduped }},
+	{"geecache_peer_loads_total", "counter", "Successful loads from peers.", func(s Stats) int64 { return s.PeerLoads }},
+	{"geecache_peer_errors_total", "counter", "Failed loads from peers.", func(s Stats) int64 { return s.PeerErrors }},
+	{"geecache_peer_retries_total", "counter", "Retried fetches from peers.", func(s Stats) int64 { return s.PeerRetries }},
+	{"geecache_peer_hedges_total", "counter", "Hedged fetches sent to the next peer on the ring.", func(s Stats) int64 { return s.PeerHedges }},
+	{"geecache_peer_not_modified_total", "counter", "Conditional fetches answered with not modified.", func(s Stats) int64 { return s.PeerNotModified }},
+	{"geecache_local_loads_total", "counter", "Successful loads from the getter.", func(s Stats) int64 { return s.LocalLoads }},
+	{"geecache_local_load_errors_total", "counter", "Failed loads from the getter.", func(s Stats) int64 { return s.LocalLoadErrs }},
+	{"geecache_refreshes_total", "counter", "Background refreshes of entries close to expiry.", func(s Stats) int64 { return s.Refreshes }},
+	{"geecache_stale_hits_total", "counter", "Expired values served because a load failed.", func(s Stats) int64 { return s.StaleHits }},
+	{"geecache_evictions_total", "counter", "Evictions from the main cache.", func(s Stats) int64 { return s.Evictions }},
+}
+
+func writeGroupMetrics(w io.Writer) {
+	mu.RLock()
+	gs := make([]*Group, 0, len(groups))
+	for _, g := range groups {
+		gs = append(gs, g)
+	}
+	mu.RUnlock()
+	sort.Slice(gs, func(i, j int) bool { return gs[i].name < gs[j].name })
+
+	stats := make([]Stats, len(gs))
+	for i, g := range gs {
+		stats[i] = g.Stats()
+	}
+	for _, gm := range groupMetrics {
+		writeHeader(w, gm.name, gm.typ, gm.help)
+		for i, g := range gs {
+			fmt.Fprintf(w, "%s{group=\"%s\"} %d\n", gm.name, escapeLabel(g.name), gm.value(stats[i]))
+		}
+	}
+
+	writeHeader(w, "geecache_cache_bytes", "gauge", "Bytes used by the main and hot cache.")
+	for _, g := range gs {
+		fmt.Fprintf(w, "geecache_cache_bytes{group=\"%s\",cache=\"main\"} %d\n", escapeLabel(g.name), g.CacheStats().Bytes)
+		fmt.Fprintf(w, "geecache_cache_bytes{group=\"%s\",cache=\"hot\"} %d\n", escapeLabel(g.name), g.HotCacheStats().Bytes)
+	}
+	writeHeader(w, "geecache_cache_items", "gauge", "Items in the main and hot cache.")
+	for _, g := range gs {
+		fmt.Fprintf(w, "geecache_cache_items{group=\"%s\",cache=\"main\"} %d\n", escapeLabel(g.name), g.CacheStats().Items)
+		fmt.Fprintf(w, "geecache_cache_items{group=\"%s\",cache=\"hot\"} %d\n", escapeLabel(g.name), g.HotCacheStats().Items)
+	}
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// 按Prometheus文本格式转义标签值
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
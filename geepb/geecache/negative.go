@@ -0,0 +1,84 @@
+package geecache
+
+import (
+	"errors"
+	"time"
+)
+
+// 负缓存：Getter返回可缓存的错误(默认只有ErrNotFound)时记下这个key，
+// 在较短的ttl内再次查询直接返回错误，不再访问数据库，防止缓存穿透
+
+// 负缓存默认的过期时间和大小
+// 随机key的穿透会不断写入负缓存，必须限制大小
+const (
+	defaultNegativeExpire = 10 * time.Second
+	defaultNegativeBytes  = 1 << 20
+)
+
+// negativeCache 值的第一个字节是errs中的下标，后面是错误信息
+type negativeCache struct {
+	cache
+	expire time.Duration
+	// 可以缓存的错误，用errors.Is匹配
+	errs []error
+}
+
+// negativeError 负缓存命中时返回的错误，信息和第一次加载时一样，可以用errors.Is匹配原来的哨兵错误
+type negativeError struct {
+	msg string
+	err error
+}
+
+func (e *negativeError) Error() string { return e.msg }
+
+func (e *negativeError) Unwrap() error { return e.err }
+
+func (n *negativeCache) enabled() bool {
+	return n.expire > 0
+}
+
+// add 错误可以缓存时记下这个key
+func (n *negativeCache) add(key string, err error) {
+	if !n.enabled() {
+		return
+	}
+	for i, target := range n.errs {
+		if i > 255 {
+			break
+		}
+		if errors.Is(err, target) {
+			b := make([]byte, 0, 1+len(err.Error()))
+			b = append(b, byte(i))
+			b = append(b, err.Error()...)
+			n.cache.add(key, ByteView{b: b}, n.expire)
+			return
+		}
+	}
+}
+
+// get 负缓存命中时返回缓存的错误
+func (n *negativeCache) get(key string) (error, bool) {
+	if !n.enabled() {
+		return nil, false
+	}
+	v, ok := n.cache.get(key)
+	if !ok || v.Len() == 0 {
+		return nil, false
+	}
+	b := v.ByteSlice()
+	i := int(b[0])
+	if i >= len(n.errs) {
+		return nil, false
+	}
+	return &negativeError{msg: string(b[1:]), err: n.errs[i]}, true
+}
+
+// lookupNegative 查询负缓存，命中时返回缓存的错误
+func (g *Group) lookupNegative(key string) (error, bool) {
+	err, ok := g.negCache.get(key)
+	if ok {
+		g.logger.Debug("negative cache hit", "group", g.name, "key", key)
+		g.stats.negativeHits.Add(1)
+	}
+	return err, ok
+}
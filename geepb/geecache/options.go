@@ -0,0 +1,210 @@
+package geecache
+
+import (
+	"geecache/bloom"
+	"time"
+)
+
+// GroupOption 创建缓存池时的可选配置
+type GroupOption func(*Group)
+
+// WithCacheBytes 主缓存的大小，单位字节，0表示不限制
+func WithCacheBytes(cacheBytes int64) GroupOption {
+	return func(g *Group) {
+		g.mainCache.cacheBytes = cacheBytes
+	}
+}
+
+// WithExpire 缓存池中数据的过期时间，0表示不过期
+func WithExpire(expire time.Duration) GroupOption {
+	return func(g *Group) {
+		g.Expire = expire
+	}
+}
+
+// WithExpireJitter 加载的值的过期时间随机增加最多jitter比例，比如0.1表示增加0到10%
+// 同时加载的key不会同时过期，避免一起回源
+func WithExpireJitter(jitter float64) GroupOption {
+	return func(g *Group) {
+		g.expireJitter = jitter
+	}
+}
+
+// WithPolicy 主缓存的淘汰策略
+func WithPolicy(policy Policy) GroupOption {
+	return func(g *Group) {
+		g.mainCache.policy = policy
+	}
+}
+
+// WithPeers 注册选择节点的Picker，和RegisterPeers一样
+func WithPeers(peers Picker) GroupOption {
+	return func(g *Group) {
+		g.server = peers
+	}
+}
+
+// WithHotCache 开启热点缓存，保存一部分从远程节点获取的值
+// cacheBytes是热点缓存的大小，一般比主缓存小很多，expire是热点缓存中数据的过期时间
+func WithHotCache(cacheBytes int64, expire time.Duration) GroupOption {
+	return func(g *Group) {
+		g.hotCache.cacheBytes = cacheBytes
+		g.hotExpire = expire
+	}
+}
+
+// WithCompression 主缓存和热点缓存中不小于threshold字节的值用codec压缩后存储，取出时解压
+// 压缩后没有变小的值原样存储，缓存池大小按压缩后的字节数计算
+func WithCompression(codec Codec, threshold int) GroupOption {
+	return func(g *Group) {
+		g.mainCache.codec, g.mainCache.compressThreshold = codec, threshold
+		g.hotCache.codec, g.hotCache.compressThreshold = codec, threshold
+	}
+}
+
+// WithHotCacheRevalidate 热点缓存中的副本过期后继续保留grace时间
+// 这段时间内再次访问时带着版本向负责节点获取，值没有变化时不再传输，适合较大、很少变化的值
+func WithHotCacheRevalidate(grace time.Duration) GroupOption {
+	return func(g *Group) {
+		g.hotCache.grace = grace
+	}
+}
+
+// WithHotCacheSample 从远程节点获取的值，每n个放一个到热点缓存，默认10
+func WithHotCacheSample(n int) GroupOption {
+	return func(g *Group) {
+		g.hotSample = n
+	}
+}
+
+// WithLogger 缓存池的日志，默认不输出
+func WithLogger(logger Logger) GroupOption {
+	return func(g *Group) {
+		g.logger = logger
+	}
+}
+
+// WithFetchPolicy 从远程节点获取的重试、对冲和失败回退策略
+func WithFetchPolicy(p FetchPolicy) GroupOption {
+	return func(g *Group) {
+		g.fetchPolicy = p
+	}
+}
+
+// WithNegativeCache 开启负缓存，Getter返回errs中的错误时记下这个key，ttl内再次查询直接返回这个错误
+// errs为空时只缓存ErrNotFound，ttl为0时使用defaultNegativeExpire
+// cacheBytes是负缓存的大小，不能不限制，为0时使用defaultNegativeBytes(1MB)
+func WithNegativeCache(cacheBytes int64, ttl time.Duration, errs ...error) GroupOption {
+	return func(g *Group) {
+		if ttl <= 0 {
+			ttl = defaultNegativeExpire
+		}
+		if cacheBytes <= 0 {
+			cacheBytes = defaultNegativeBytes
+		}
+		if len(errs) == 0 {
+			errs = []error{ErrNotFound}
+		}
+		g.negCache.cacheBytes = cacheBytes
+		g.negCache.expire = ttl
+		g.negCache.errs = errs
+	}
+}
+
+// WithBloomFilter 用布隆过滤器拦截一定不存在的key，f由应用写入所有存在的key，或者从快照加载
+func WithBloomFilter(f *bloom.Filter) GroupOption {
+	return func(g *Group) {
+		g.SetBloomFilter(f)
+	}
+}
+
+// WithBloomLearning 学习模式，加载成功和Set的key加入过滤器，可以用BloomFilter保存快照
+// 学到的过滤器不完整，只学习不拦截；和WithBloomFilter一起用时拦截并且继续学习新的key
+// 没有用WithBloomFilter指定过滤器时按预计的key数量n创建一个，误判率1%
+func WithBloomLearning(n uint64) GroupOption {
+	return func(g *Group) {
+		g.guard.learn = true
+		if g.guard.filter.Load() == nil {
+			g.guard.filter.Store(bloom.New(n, defaultBloomFP))
+		}
+	}
+}
+
+// WithRefreshAhead 主缓存的条目在过期前window时间内被访问时，返回当前的值并在后台重新加载
+func WithRefreshAhead(window time.Duration) GroupOption {
+	return func(g *Group) {
+		g.refreshWindow = window
+	}
+}
+
+// WithStaleIfError 主缓存的条目过期后继续保留grace时间，这段时间内加载失败时返回旧值
+// 条目会多占用grace时间的缓存空间，Getter返回ErrNotFound时不使用旧值
+func WithStaleIfError(grace time.Duration) GroupOption {
+	return func(g *Group) {
+		g.mainCache.grace = grace
+	}
+}
+
+// ServerOption 创建server时的可选配置
+type ServerOption func(*server)
+
+// WithMetricsAddr Start时在addr上启动http服务，在/metrics导出Prometheus格式的监控指标
+func WithMetricsAddr(addr string) ServerOption {
+	return func(s *server) {
+		s.metricsAddr = addr
+	}
+}
+
+// WithStaticPeers 静态节点模式，不使用etcd
+// Start时不向etcd注册，SetPeers的地址由client直接用gRPC连接
+func WithStaticPeers() ServerOption {
+	return func(s *server) {
+		s.static = true
+	}
+}
+
+// WithDiscovery 使用的服务发现，默认按WithRegistry的配置使用etcd
+// registry包提供了etcd、静态列表、DNS和文件几种实现
+func WithDiscovery(d Discovery) ServerOption {
+	return func(s *server) {
+		s.discovery = d
+		s.static = false
+	}
+}
+
+// WithRegistry etcd注册中心的配置，server注册自己和它创建的client发现节点时使用
+func WithRegistry(config RegistryConfig) ServerOption {
+	return func(s *server) {
+		s.registry = config
+	}
+}
+
+// WithConnManager 使用共用的连接管理器，同一个进程里的多个server共用到其他节点的连接
+// 共用的连接管理器由调用方关闭，Shutdown不会关闭它
+func WithConnManager(m *ConnManager) ServerOption {
+	return func(s *server) {
+		s.conns = m
+	}
+}
+
+// WithCircuitBreaker 每个远程节点的熔断器配置，默认连续失败5次后打开10秒
+func WithCircuitBreaker(cfg BreakerConfig) ServerOption {
+	return func(s *server) {
+		s.breakerConfig = cfg
+	}
+}
+
+// WithRPCCompression 请求其他节点时用name压缩请求，对方用同样的算法压缩响应
+// name是注册到gRPC的压缩算法，gzip已经注册，所有节点都要注册同样的算法
+func WithRPCCompression(name string) ServerOption {
+	return func(s *server) {
+		s.rpcCompressor = name
+	}
+}
+
+// WithServerLogger server和它创建的client的日志，默认不输出
+func WithServerLogger(logger Logger) ServerOption {
+	return func(s *server) {
+		s.logger = logger
+	}
+}
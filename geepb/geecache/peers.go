@@ -1,5 +1,11 @@
 package geecache
 
+import (
+	"context"
+	"hash/fnv"
+	"time"
+)
+
 // 传入key选择节点
 //
 //	type PeerPicker interface {
@@ -11,6 +17,18 @@ type Picker interface {
 	Pick(key string) (peer Fetcher, ok bool)
 }
 
+// OwnerPicker 可选接口，返回真正负责key的节点，不考虑熔断等临时状态
+// Pick在节点不可用时可以返回false让调用方从本地加载，但写入和删除必须交给负责的节点
+type OwnerPicker interface {
+	Owner(key string) (peer Fetcher, ok bool)
+}
+
+// PeerLister 可选接口，返回除自己以外的所有远程节点
+// Picker实现了它时，Set和Remove之后通知这些节点清除副本
+type PeerLister interface {
+	Peers() []Fetcher
+}
+
 // 从对应的group里查找缓存值，
 // type PeerGetter interface {
 // Get(group string, key string) ([]byte, error)
@@ -19,6 +37,92 @@ type Picker interface {
 //	}
 //
 // 客户端接口，RPC方法请求服务端返回值
+// ctx的超时和取消会传递给RPC调用
 type Fetcher interface {
-	Fetch(group string, key string) ([]byte, error)
+	Fetch(ctx context.Context, group string, key string) ([]byte, error)
+}
+
+// EntryFetcher 可选接口，获取值的同时返回负责节点上的过期时间和版本
+// 没有实现时热点缓存中的副本只按WithHotCache的过期时间过期
+type EntryFetcher interface {
+	FetchEntry(ctx context.Context, group string, key string) (Entry, error)
+}
+
+// WritableFetcher 可选接口，在远程节点写入和删除
+// Set和Remove要求负责这个key的节点实现它，清除副本时跳过没有实现的节点
+type WritableFetcher interface {
+	// Set 在远程节点写入一个值，ttl为0时使用缓存池的过期时间，小于0时不过期
+	Set(ctx context.Context, group string, key string, value []byte, ttl time.Duration) error
+	// Delete 在远程节点删除一个值，localOnly为true时只清除那个节点上的副本
+	Delete(ctx context.Context, group string, key string, localOnly bool) error
+}
+
+// BatchFetcher 可选接口，一次请求获取多个key，errs是单个key的错误，err是整个请求的错误
+// 没有实现时GetMany逐个获取这个节点负责的key
+type BatchFetcher interface {
+	BatchFetch(ctx context.Context, group string, keys []string) (values map[string]Entry, errs map[string]error, err error)
+}
+
+// Entry 从远程节点获取的值，带着负责节点上的过期时间和版本
+// 非负责节点缓存副本时不会超过Expire，客户端也可以据此决定自己缓存多久
+type Entry struct {
+	Value []byte
+	// Expire 负责节点上这个值过期的时间点，零值表示不过期或者不知道
+	Expire time.Time
+	// Version 值的版本，值不变时版本不变，可以作为ETag
+	Version uint64
+	// NotModified 按版本获取时值没有变化，Value为空
+	NotModified bool
+}
+
+// ConditionalFetcher 可选接口，带着持有的版本获取，远程节点上的版本一样时不再传输值
+// Fetcher实现了它时，热点缓存中过期的副本通过它重新验证
+type ConditionalFetcher interface {
+	FetchIfChanged(ctx context.Context, group string, key string, version uint64) (Entry, error)
+}
+
+// fetchEntry 节点实现了EntryFetcher时带着过期时间和版本获取，否则只有值
+func fetchEntry(ctx context.Context, peer Fetcher, group string, key string) (Entry, error) {
+	if ef, ok := peer.(EntryFetcher); ok {
+		return ef.FetchEntry(ctx, group, key)
+	}
+	value, err := peer.Fetch(ctx, group, key)
+	if err != nil {
+		return Entry{}, err
+	}
+	return Entry{Value: value}, nil
+}
+
+// valueVersion 值的版本，取内容的哈希，不同节点加载到同样的值时版本一样
+func valueVersion(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	return h.Sum64()
+}
+
+// 过期时间点和Unix毫秒的转换，0表示不过期
+func expireToMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// ttlToMillis Set请求中的ttl，单位毫秒，小于0都是-1表示不过期，不足1毫秒的向上取整，不会变成0
+func ttlToMillis(ttl time.Duration) int64 {
+	if ttl < 0 {
+		return -1
+	}
+	ms := ttl.Milliseconds()
+	if time.Duration(ms)*time.Millisecond < ttl {
+		ms++
+	}
+	return ms
+}
+
+func millisToExpire(ms int64) time.Time {
+	if ms <= 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
 }
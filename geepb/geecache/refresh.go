@@ -0,0 +1,51 @@
+package geecache
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// 提前刷新：主缓存的条目快过期时，Get照常返回当前的值，同时在后台通过singleflight重新加载一次，
+// 热点key不会在过期的一瞬间让所有请求都等待加载。
+// 过期后保留：条目过期后在保留期内不删除，加载失败时返回旧值
+
+// maybeRefresh 条目进入刷新窗口时在后台重新加载，同一个key同时只有一个刷新
+func (g *Group) maybeRefresh(key string, expire time.Time) {
+	if g.refreshWindow <= 0 || expire.IsZero() || time.Until(expire) > g.refreshWindow {
+		return
+	}
+	if _, loaded := g.refreshing.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+	g.stats.refreshes.Add(1)
+	go func() {
+		defer g.refreshing.Delete(key)
+		// 和正常的加载共用singleflight，同时没有命中的请求会等这次刷新的结果
+		_, err := g.loader.DoContext(context.Background(), key, func(ctx context.Context) (interface{}, error) {
+			return g.getLocally(ctx, key)
+		})
+		if err == nil {
+			return
+		}
+		// 数据已经删除了，旧值不能再用
+		if errors.Is(err, ErrNotFound) {
+			g.mainCache.remove(key)
+			return
+		}
+		g.logger.Warn("refresh failed", "group", g.name, "key", key, "err", err)
+	}()
+}
+
+// staleOnError 加载失败时查找保留期内的旧值，key不存在或者调用方放弃时不使用旧值
+func (g *Group) staleOnError(ctx context.Context, key string, err error) (ByteView, bool) {
+	if g.mainCache.grace <= 0 || ctx.Err() != nil || errors.Is(err, ErrNotFound) {
+		return ByteView{}, false
+	}
+	v, ok := g.mainCache.getStale(key)
+	if ok {
+		g.stats.staleHits.Add(1)
+		g.logger.Warn("load failed, serving stale value", "group", g.name, "key", key, "err", err)
+	}
+	return v, ok
+}
@@ -0,0 +1,115 @@
+package registry
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// 零值字段使用的默认配置
+const (
+	DefaultEndpoint    = "localhost:2379"
+	DefaultDialTimeout = 5 * time.Second
+	DefaultLeaseTTL    = 5 // 单位秒
+	DefaultPrefix      = "geecache"
+)
+
+// Config etcd注册中心的配置，零值字段使用默认值
+type Config struct {
+	// etcd的地址，为空时使用localhost:2379
+	Endpoints []string
+	// 连接etcd的超时时间，为0时使用5秒
+	DialTimeout time.Duration
+	// etcd的用户名和密码，为空时不认证
+	Username string
+	Password string
+	// 连接etcd的TLS配置，设置了就不再读取下面的证书文件
+	TLS *tls.Config
+	// 客户端证书、私钥和CA证书文件，PEM格式
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	// 注册服务的租约时间，单位秒，为0时使用5秒
+	LeaseTTL int64
+	// 服务在etcd中的key前缀，为空时使用geecache
+	Prefix string
+}
+
+// EtcdConfig 转换成etcd客户端的配置
+func (c Config) EtcdConfig() (clientv3.Config, error) {
+	cfg := clientv3.Config{
+		Endpoints:   c.Endpoints,
+		DialTimeout: c.DialTimeout,
+		Username:    c.Username,
+		Password:    c.Password,
+	}
+	if len(cfg.Endpoints) == 0 {
+		cfg.Endpoints = []string{DefaultEndpoint}
+	}
+	if cfg.DialTimeout == 0 {
+		cfg.DialTimeout = DefaultDialTimeout
+	}
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return clientv3.Config{}, err
+	}
+	cfg.TLS = tlsConfig
+	return cfg, nil
+}
+
+// 读取TLS配置，没有配置TLS时返回nil
+func (c Config) tlsConfig() (*tls.Config, error) {
+	if c.TLS != nil {
+		return c.TLS, nil
+	}
+	if c.CertFile == "" && c.KeyFile == "" && c.CAFile == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load etcd client certificate failed: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read etcd CA file failed: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in etcd CA file %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// leaseTTL 注册服务的租约时间
+func (c Config) leaseTTL() int64 {
+	if c.LeaseTTL <= 0 {
+		return DefaultLeaseTTL
+	}
+	return c.LeaseTTL
+}
+
+// prefix 服务在etcd中的key前缀，不带结尾的/
+func (c Config) prefix() string {
+	prefix := strings.TrimSuffix(c.Prefix, "/")
+	if prefix == "" {
+		return DefaultPrefix
+	}
+	return prefix
+}
+
+// ServiceName 加上key前缀的服务名，例如 geecache/127.0.0.1:8080
+func (c Config) ServiceName(name string) string {
+	return c.prefix() + "/" + name
+}
@@ -1,10 +1,13 @@
 package registry
 
 import (
+	"context"
+	"fmt"
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/naming/endpoints"
 	"go.etcd.io/etcd/client/v3/naming/resolver"
 	"google.golang.org/grpc"
-	"log"
+	"sort"
 )
 
 // EtcdDial 向grpc请求一个服务，用于连接到一个通过etcd注册的grpc服务，该函数会使用etcd作为服务发现机制，
@@ -14,7 +17,6 @@ func EtcdDial(c *clientv3.Client, service string) (*grpc.ClientConn, error) {
 	//c：一个创建好的etcd客户端，用于服务发现，service:需要连接的服务名称。返回一个gprc客户端连接和一个可能的错误
 	//使用传入的etcd客户端创建一个etcd解析器
 	etcdResolver, err := resolver.NewBuilder(c)
-	log.Println("Trying to dial etcd with service name:", service)
 	if err != nil {
 		return nil, err
 	}
@@ -28,9 +30,74 @@ func EtcdDial(c *clientv3.Client, service string) (*grpc.ClientConn, error) {
 		grpc.WithInsecure(),
 		grpc.FailOnNonTempDialError(true), // Fail fast on permanent errors
 	)
+	// 不在这里打日志，错误返回给调用方，由ConnManager的使用者按自己的Logger记录
 	if err != nil {
-		log.Printf("Failed to connect to service: %v", err)
 		return nil, err
 	}
 	return conn, err
 }
+
+// Watch 监听key前缀下注册的所有节点，节点加入或离开时用最新的地址列表回调update
+// 第一次回调是当前已注册的节点，ctx结束时返回nil，监听中断时返回错误
+func Watch(ctx context.Context, config Config, update func(addrs []string)) error {
+	etcdConfig, err := config.EtcdConfig()
+	if err != nil {
+		return err
+	}
+	cli, err := clientv3.New(etcdConfig)
+	if err != nil {
+		return fmt.Errorf("create etcd client failed: %v", err)
+	}
+	defer cli.Close()
+	return etcdWatch(ctx, cli, config.prefix(), update)
+}
+
+// etcdWatch 用已有的etcd客户端监听prefix下注册的节点
+func etcdWatch(ctx context.Context, cli *clientv3.Client, prefix string, update func(addrs []string)) error {
+	em, err := endpoints.NewManager(cli, prefix)
+	if err != nil {
+		return err
+	}
+	ch, err := em.NewWatchChannel(ctx)
+	if err != nil {
+		return fmt.Errorf("watch %s failed: %v", prefix, err)
+	}
+	// etcd中的key -> 节点地址
+	nodes := make(map[string]string)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ups, ok := <-ch:
+			if !ok {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return fmt.Errorf("watch %s closed", prefix)
+			}
+			for _, up := range ups {
+				switch up.Op {
+				case endpoints.Add:
+					nodes[up.Key] = up.Endpoint.Addr
+				case endpoints.Delete:
+					delete(nodes, up.Key)
+				}
+			}
+			update(nodeAddrs(nodes))
+		}
+	}
+}
+
+// 去重并排序的节点地址
+func nodeAddrs(nodes map[string]string) []string {
+	seen := make(map[string]bool, len(nodes))
+	addrs := make([]string, 0, len(nodes))
+	for _, addr := range nodes {
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
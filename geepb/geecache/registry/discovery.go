@@ -0,0 +1,38 @@
+package registry
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// Discovery 服务发现接口，server用它注册自己并发现其他节点
+// 内置etcd、静态列表、DNS和文件四种实现
+type Discovery interface {
+	// Register 注册一个节点，注册后一直保持，直到Deregister
+	Register(ctx context.Context, addr string) error
+	// Deregister 注销一个节点
+	Deregister(ctx context.Context, addr string) error
+	// Watch 监听节点列表，节点加入或离开时用最新的地址列表回调update
+	// 一直阻塞，ctx结束时返回nil，监听中断时返回错误
+	Watch(ctx context.Context, update func(addrs []string)) error
+}
+
+// Dialer 可选接口，能按服务名建立gRPC连接的Discovery实现它，例如etcd
+// 没有实现的Discovery，client直接连接节点地址
+type Dialer interface {
+	Dial(service string) (*grpc.ClientConn, error)
+}
+
+// 判断两个已排序的地址列表是否相同
+func sameAddrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
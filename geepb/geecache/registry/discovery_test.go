@@ -0,0 +1,123 @@
+package registry
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// 在后台运行Watch，把每次回调的节点列表发到channel
+func watch(t *testing.T, d Discovery) (<-chan []string, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan []string, 10)
+	go func() {
+		if err := d.Watch(ctx, func(addrs []string) { ch <- addrs }); err != nil {
+			t.Errorf("watch: %v", err)
+		}
+	}()
+	return ch, cancel
+}
+
+func expectAddrs(t *testing.T, ch <-chan []string, want ...string) {
+	t.Helper()
+	select {
+	case got := <-ch:
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no update, want %v", want)
+	}
+}
+
+func TestStatic(t *testing.T) {
+	d := NewStatic("127.0.0.1:8002", "127.0.0.1:8001")
+	if err := d.Register(context.Background(), "127.0.0.1:8003"); err != nil {
+		t.Fatal(err)
+	}
+	ch, cancel := watch(t, d)
+	defer cancel()
+	expectAddrs(t, ch, "127.0.0.1:8001", "127.0.0.1:8002")
+}
+
+func TestFile(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name, first, second string
+	}{
+		{"peers.json", `{"peers": ["127.0.0.1:8001"]}`, `{"peers": ["127.0.0.1:8002", "127.0.0.1:8001"]}`},
+		{"peers.yaml", "peers:\n  - 127.0.0.1:8001\n", "peers:\n  - 127.0.0.1:8002\n  - 127.0.0.1:8001\n"},
+	} {
+		path := filepath.Join(dir, tc.name)
+		if err := os.WriteFile(path, []byte(tc.first), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		ch, cancel := watch(t, NewFile(path, 10*time.Millisecond))
+		expectAddrs(t, ch, "127.0.0.1:8001")
+
+		// 修改文件后重新加载
+		if err := os.WriteFile(path, []byte(tc.second), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		expectAddrs(t, ch, "127.0.0.1:8001", "127.0.0.1:8002")
+		cancel()
+	}
+
+	if err := NewFile(filepath.Join(dir, "missing.json"), 0).Watch(context.Background(), func([]string) {}); err == nil {
+		t.Fatal("missing file should fail")
+	}
+}
+
+// 测试用的DNS解析
+type fakeResolver struct {
+	srvs  []*net.SRV
+	hosts map[string][]net.IPAddr
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	return name, r.srvs, nil
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return r.hosts[host], nil
+}
+
+func TestDNS(t *testing.T) {
+	r := &fakeResolver{
+		srvs: []*net.SRV{
+			{Target: "node-b.example.com.", Port: 8002},
+			{Target: "node-a.example.com.", Port: 8001},
+		},
+		hosts: map[string][]net.IPAddr{
+			"node-a.example.com": {{IP: net.ParseIP("10.0.0.1")}},
+			"node-b.example.com": {{IP: net.ParseIP("10.0.0.2")}, {IP: net.ParseIP("::1")}},
+			"cache.example.com":  {{IP: net.ParseIP("10.0.0.3")}, {IP: net.ParseIP("10.0.0.4")}},
+		},
+	}
+
+	// SRV记录，端口取自记录，忽略IPv6
+	srv := NewDNS("_geecache._tcp.example.com", "", 0)
+	srv.resolver = r
+	addrs, err := srv.lookup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.1:8001", "10.0.0.2:8002"}; !reflect.DeepEqual(addrs, want) {
+		t.Fatalf("got %v, want %v", addrs, want)
+	}
+
+	// A记录使用指定的端口
+	a := NewDNS("cache.example.com", "9999", 0)
+	a.resolver = r
+	addrs, err = a.lookup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.3:9999", "10.0.0.4:9999"}; !reflect.DeepEqual(addrs, want) {
+		t.Fatalf("got %v, want %v", addrs, want)
+	}
+}
@@ -0,0 +1,115 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 默认多久重新解析一次DNS
+const defaultDNSInterval = 30 * time.Second
+
+// DNSDiscovery 定期解析DNS记录得到节点列表，节点由DNS维护，不需要注册
+// 以下划线开头的名字按SRV记录解析，例如 _geecache._tcp.example.com，端口取自SRV记录
+// 其他名字按A记录解析，端口使用port
+// 只使用IPv4地址
+type DNSDiscovery struct {
+	name     string
+	port     string
+	interval time.Duration
+	resolver dnsResolver
+}
+
+// dnsResolver net.Resolver中用到的方法，测试时可以替换
+type dnsResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+var _ Discovery = (*DNSDiscovery)(nil)
+
+// NewDNS 创建DNS服务发现，interval为0时每30秒解析一次
+func NewDNS(name, port string, interval time.Duration) *DNSDiscovery {
+	if interval <= 0 {
+		interval = defaultDNSInterval
+	}
+	return &DNSDiscovery{name: name, port: port, interval: interval, resolver: net.DefaultResolver}
+}
+
+// Register 节点由DNS维护，不需要注册
+func (d *DNSDiscovery) Register(ctx context.Context, addr string) error {
+	return nil
+}
+
+// Deregister 节点由DNS维护，不需要注销
+func (d *DNSDiscovery) Deregister(ctx context.Context, addr string) error {
+	return nil
+}
+
+// Watch 定期解析DNS，节点列表变化时回调update
+// 第一次解析失败返回错误，之后解析失败时保留上一次的列表
+func (d *DNSDiscovery) Watch(ctx context.Context, update func(addrs []string)) error {
+	addrs, err := d.lookup(ctx)
+	if err != nil {
+		return err
+	}
+	update(addrs)
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			latest, err := d.lookup(ctx)
+			if err != nil || sameAddrs(addrs, latest) {
+				continue
+			}
+			addrs = latest
+			update(addrs)
+		}
+	}
+}
+
+// lookup 解析一次，返回排序后的ip:port
+func (d *DNSDiscovery) lookup(ctx context.Context) ([]string, error) {
+	seen := make(map[string]bool)
+	var addrs []string
+	add := func(host, port string) error {
+		ips, err := d.resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return fmt.Errorf("lookup %s failed: %v", host, err)
+		}
+		for _, ip := range ips {
+			if ip.IP.To4() == nil {
+				continue
+			}
+			addr := net.JoinHostPort(ip.IP.String(), port)
+			if !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+		return nil
+	}
+
+	if strings.HasPrefix(d.name, "_") {
+		_, srvs, err := d.resolver.LookupSRV(ctx, "", "", d.name)
+		if err != nil {
+			return nil, fmt.Errorf("lookup SRV %s failed: %v", d.name, err)
+		}
+		for _, srv := range srvs {
+			if err := add(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))); err != nil {
+				return nil, err
+			}
+		}
+	} else if err := add(d.name, d.port); err != nil {
+		return nil, err
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
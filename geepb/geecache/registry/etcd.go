@@ -0,0 +1,215 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+)
+
+// EtcdDiscovery 基于etcd的服务发现
+// 节点以租约的方式注册在 前缀/addr/addr 下，租约到期记录自动删除
+// 所有操作共用一个etcd客户端，第一次使用时创建
+type EtcdDiscovery struct {
+	config Config
+
+	mu            sync.Mutex
+	cli           *clientv3.Client
+	registrations map[string]*etcdRegistration // addr -> 注册信息
+
+	// SharedEtcd返回的实例在shared中的key和引用计数
+	sharedKey string
+	refs      int
+}
+
+// 进程内共享的etcd服务发现，相同的配置共用一个etcd客户端
+var shared = struct {
+	sync.Mutex
+	m map[string]*EtcdDiscovery
+}{m: make(map[string]*EtcdDiscovery)}
+
+// 一个节点的注册信息
+type etcdRegistration struct {
+	lease  clientv3.LeaseID
+	cancel context.CancelFunc // 停止续约
+}
+
+var _ Discovery = (*EtcdDiscovery)(nil)
+var _ Dialer = (*EtcdDiscovery)(nil)
+
+// NewEtcd 按配置创建etcd服务发现
+func NewEtcd(config Config) *EtcdDiscovery {
+	return &EtcdDiscovery{
+		config:        config,
+		registrations: make(map[string]*etcdRegistration),
+	}
+}
+
+// SharedEtcd 返回进程内共享的etcd服务发现，相同的配置只创建一个etcd客户端
+// 每次调用都要对应一次Close，最后一次Close时才真正关闭etcd客户端
+func SharedEtcd(config Config) *EtcdDiscovery {
+	key := fmt.Sprintf("%+v", config)
+	shared.Lock()
+	defer shared.Unlock()
+	d, ok := shared.m[key]
+	if !ok {
+		d = NewEtcd(config)
+		d.sharedKey = key
+		shared.m[key] = d
+	}
+	d.refs++
+	return d
+}
+
+// client 返回共用的etcd客户端
+func (d *EtcdDiscovery) client() (*clientv3.Client, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cli != nil {
+		return d.cli, nil
+	}
+	etcdConfig, err := d.config.EtcdConfig()
+	if err != nil {
+		return nil, err
+	}
+	cli, err := clientv3.New(etcdConfig)
+	if err != nil {
+		return nil, fmt.Errorf("create etcd client failed: %v", err)
+	}
+	d.cli = cli
+	return cli, nil
+}
+
+// Register 创建租约并注册节点，后台持续续约
+// 租约失效(例如和etcd断开太久)时会重新注册
+func (d *EtcdDiscovery) Register(ctx context.Context, addr string) error {
+	cli, err := d.client()
+	if err != nil {
+		return err
+	}
+	lease, err := d.grant(ctx, cli, addr)
+	if err != nil {
+		return err
+	}
+	kctx, cancel := context.WithCancel(context.Background())
+	reg := &etcdRegistration{lease: lease, cancel: cancel}
+
+	d.mu.Lock()
+	if old, ok := d.registrations[addr]; ok {
+		old.cancel()
+	}
+	d.registrations[addr] = reg
+	d.mu.Unlock()
+
+	go d.keepAlive(kctx, cli, addr, reg)
+	return nil
+}
+
+// grant 创建租约并写入节点记录
+func (d *EtcdDiscovery) grant(ctx context.Context, cli *clientv3.Client, addr string) (clientv3.LeaseID, error) {
+	resp, err := cli.Grant(ctx, d.config.leaseTTL())
+	if err != nil {
+		return 0, fmt.Errorf("create lease failed: %v", err)
+	}
+	if err := etcdAdd(cli, resp.ID, d.config.ServiceName(addr), addr); err != nil {
+		return 0, fmt.Errorf("add etcd record failed: %v", err)
+	}
+	return resp.ID, nil
+}
+
+// keepAlive 续约，直到ctx结束
+func (d *EtcdDiscovery) keepAlive(ctx context.Context, cli *clientv3.Client, addr string, reg *etcdRegistration) {
+	d.mu.Lock()
+	lease := reg.lease
+	d.mu.Unlock()
+	for {
+		ch, err := cli.KeepAlive(ctx, lease)
+		if err == nil {
+			for range ch {
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		// 续约中断，等一会儿重新注册
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+		if newLease, err := d.grant(ctx, cli, addr); err == nil {
+			d.mu.Lock()
+			reg.lease = newLease
+			d.mu.Unlock()
+			lease = newLease
+		}
+	}
+}
+
+// Deregister 停止续约并撤销租约，节点记录随之删除
+func (d *EtcdDiscovery) Deregister(ctx context.Context, addr string) error {
+	d.mu.Lock()
+	reg, ok := d.registrations[addr]
+	delete(d.registrations, addr)
+	cli := d.cli
+	d.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	reg.cancel()
+	d.mu.Lock()
+	lease := reg.lease
+	d.mu.Unlock()
+	if _, err := cli.Revoke(ctx, lease); err != nil {
+		return fmt.Errorf("revoke lease of %s failed: %v", addr, err)
+	}
+	return nil
+}
+
+// Watch 监听前缀下注册的所有节点
+func (d *EtcdDiscovery) Watch(ctx context.Context, update func(addrs []string)) error {
+	cli, err := d.client()
+	if err != nil {
+		return err
+	}
+	return etcdWatch(ctx, cli, d.config.prefix(), update)
+}
+
+// Dial 通过etcd解析服务名，建立gRPC连接
+func (d *EtcdDiscovery) Dial(service string) (*grpc.ClientConn, error) {
+	cli, err := d.client()
+	if err != nil {
+		return nil, err
+	}
+	return EtcdDial(cli, service)
+}
+
+// Close 关闭etcd客户端，已经注册的节点在租约到期后删除
+// SharedEtcd返回的实例，还有其他使用者时不关闭
+func (d *EtcdDiscovery) Close() error {
+	if d.sharedKey != "" {
+		shared.Lock()
+		d.refs--
+		if d.refs > 0 {
+			shared.Unlock()
+			return nil
+		}
+		delete(shared.m, d.sharedKey)
+		shared.Unlock()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for addr, reg := range d.registrations {
+		reg.cancel()
+		delete(d.registrations, addr)
+	}
+	if d.cli == nil {
+		return nil
+	}
+	err := d.cli.Close()
+	d.cli = nil
+	return err
+}
@@ -0,0 +1,109 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 默认多久检查一次文件是否变化
+const defaultFileInterval = time.Second
+
+// FileDiscovery 从JSON或YAML文件读取节点列表，文件变化时重新加载
+// .yaml和.yml按YAML解析，其他按JSON解析，格式为
+//
+//	{"peers": ["127.0.0.1:8001", "127.0.0.1:8002"]}
+//
+// 节点列表由文件维护，不需要注册
+type FileDiscovery struct {
+	path     string
+	interval time.Duration
+}
+
+// 文件的内容
+type peersFile struct {
+	Peers []string `json:"peers" yaml:"peers"`
+}
+
+var _ Discovery = (*FileDiscovery)(nil)
+
+// NewFile 创建文件服务发现，interval为0时每秒检查一次文件
+func NewFile(path string, interval time.Duration) *FileDiscovery {
+	if interval <= 0 {
+		interval = defaultFileInterval
+	}
+	return &FileDiscovery{path: path, interval: interval}
+}
+
+// Register 节点列表由文件维护，不需要注册
+func (d *FileDiscovery) Register(ctx context.Context, addr string) error {
+	return nil
+}
+
+// Deregister 节点列表由文件维护，不需要注销
+func (d *FileDiscovery) Deregister(ctx context.Context, addr string) error {
+	return nil
+}
+
+// Watch 读取文件并定期检查修改时间和大小，变化时重新加载
+// 第一次读取失败返回错误，之后读取失败(例如正在写入)时保留上一次的列表
+func (d *FileDiscovery) Watch(ctx context.Context, update func(addrs []string)) error {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return err
+	}
+	addrs, err := d.load()
+	if err != nil {
+		return err
+	}
+	update(addrs)
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			latest, err := os.Stat(d.path)
+			if err != nil || (latest.ModTime().Equal(info.ModTime()) && latest.Size() == info.Size()) {
+				continue
+			}
+			peers, err := d.load()
+			if err != nil {
+				continue
+			}
+			info = latest
+			if sameAddrs(addrs, peers) {
+				continue
+			}
+			addrs = peers
+			update(addrs)
+		}
+	}
+}
+
+// load 读取并解析文件，返回排序后的节点地址
+func (d *FileDiscovery) load() ([]string, error) {
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		return nil, err
+	}
+	var f peersFile
+	switch filepath.Ext(d.path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &f)
+	default:
+		err = json.Unmarshal(data, &f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s failed: %v", d.path, err)
+	}
+	sort.Strings(f.Peers)
+	return f.Peers, nil
+}
@@ -5,17 +5,9 @@ import (
 	"fmt"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.etcd.io/etcd/client/v3/naming/endpoints"
-	"log"
-	"time"
 )
 
 // register模块提供服务Service注册至etcd的能力
-var (
-	defaultEtcdConfig = clientv3.Config{
-		Endpoints:   []string{"localhost:2379"},
-		DialTimeout: 5 * time.Second,
-	}
-)
 
 // etcdAdd 在租赁模式添加一对kv（服务名和地址）至etcd
 // 租约lid到期，端点信息删除
@@ -32,17 +24,26 @@ func etcdAdd(c *clientv3.Client, lid clientv3.LeaseID, service string, addr stri
 	return em.AddEndpoint(c.Ctx(), service+"/"+addr, endpoints.Endpoint{Addr: addr}, clientv3.WithLease(lid))
 }
 
-// Register 注册一个服务至etcd，不同端口是不同服务
+// Register 使用默认配置注册一个服务至etcd，不同端口是不同服务
 // 注意 Register将不会return 如果没有error的话
 func Register(service string, addr string, stop chan error) error {
+	return RegisterWithConfig(Config{}, service, addr, stop)
+}
+
+// RegisterWithConfig 按配置连接etcd并注册一个服务，和Register一样不会return，直到stop或出错
+func RegisterWithConfig(config Config, service string, addr string, stop chan error) error {
+	etcdConfig, err := config.EtcdConfig()
+	if err != nil {
+		return err
+	}
 	// 创建一个etcd client
-	cli, err := clientv3.New(defaultEtcdConfig)
+	cli, err := clientv3.New(etcdConfig)
 	if err != nil {
 		return fmt.Errorf("create etcd client failed: %v", err)
 	}
 	defer cli.Close()
-	// 创建一个租约 配置5秒过期
-	resp, err := cli.Grant(context.Background(), 5)
+	// 创建一个租约，到期后服务记录被删除
+	resp, err := cli.Grant(context.Background(), config.leaseTTL())
 	if err != nil {
 		return fmt.Errorf("create lease failed: %v", err)
 	}
@@ -58,24 +59,19 @@ func Register(service string, addr string, stop chan error) error {
 		return fmt.Errorf("set keepalive failed: %v", err)
 	}
 
-	log.Printf("[%s] register service ok\n", addr)
+	// 不打日志，停止的原因通过返回值告诉调用方
 	for {
 		select {
 		// 停止服务注册
 		case err := <-stop:
-			if err != nil {
-				log.Println(err)
-			}
 			return err
 			//客户端关闭
 		case <-cli.Ctx().Done():
-			log.Println("service closed")
 			return nil
 			// 返回false，租约撤销，
 		case _, ok := <-ch:
 			// 监听租约
 			if !ok {
-				log.Println("keep alive channel closed")
 				_, err := cli.Revoke(context.Background(), leaseId)
 				return err
 			}
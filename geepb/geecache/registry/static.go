@@ -0,0 +1,37 @@
+package registry
+
+import (
+	"context"
+	"sort"
+)
+
+// StaticDiscovery 固定的节点列表，不依赖外部服务
+type StaticDiscovery struct {
+	addrs []string
+}
+
+var _ Discovery = (*StaticDiscovery)(nil)
+
+// NewStatic 用固定的节点地址创建服务发现
+func NewStatic(addrs ...string) *StaticDiscovery {
+	sorted := append([]string(nil), addrs...)
+	sort.Strings(sorted)
+	return &StaticDiscovery{addrs: sorted}
+}
+
+// Register 节点列表是固定的，不需要注册
+func (d *StaticDiscovery) Register(ctx context.Context, addr string) error {
+	return nil
+}
+
+// Deregister 节点列表是固定的，不需要注销
+func (d *StaticDiscovery) Deregister(ctx context.Context, addr string) error {
+	return nil
+}
+
+// Watch 回调一次节点列表，然后等待ctx结束
+func (d *StaticDiscovery) Watch(ctx context.Context, update func(addrs []string)) error {
+	update(append([]string(nil), d.addrs...))
+	<-ctx.Done()
+	return nil
+}
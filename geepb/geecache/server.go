@@ -2,16 +2,20 @@ package geecache
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	pb "geecache/geecachepb"
 	consistenthash "geecache/hash"
 	"geecache/registry"
 	"google.golang.org/grpc"
-	"log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+	"io"
 	"net"
+	"net/http"
+	"sort"
 	"strings"
-
-	clientv3 "go.etcd.io/etcd/client/v3"
 	"sync"
 	"time"
 )
@@ -24,36 +28,83 @@ const (
 	defaultReplicas = 50
 )
 
-// 配置了 etcd 客户端的默认设置，包括 etcd 服务的端点地址和拨号超时时间。这是用于服务发现和注册的配置，确保服务器可以与 etcd 集群正确通信。
-var (
-	defaultEtcdConfig = clientv3.Config{
-		Endpoints:   []string{"localhost:2380"},
-		DialTimeout: 5 * time.Second,
-	}
-)
+// RegistryConfig etcd注册中心的配置，包括地址、超时、认证、TLS、租约时间和key前缀
+// 零值字段使用默认值，零值的RegistryConfig连接localhost:2379
+type RegistryConfig = registry.Config
+
+// Discovery 服务发现，负责注册本节点和发现其他节点
+type Discovery = registry.Discovery
 
 // 服务端，使用etcd客户端向etcd服务端注册服务
 type server struct {
 	pb.UnimplementedGroupCacheServer //protobuf生成的接口，确保server结构体实现了必须的grpc方法
 
-	addr       string     // format: ip:port
-	status     bool       // true: running false: stop
-	stopSignal chan error // 通知registry revoke服务
+	addr       string        // format: ip:port
+	status     bool          // true: running false: stop
+	starting   chan struct{} // Start正在监听和注册(不持有锁)时不为nil，完成后关闭，Shutdown等它完成
+	grpcServer *grpc.Server
 	mu         sync.Mutex
 	consHash   *consistenthash.Map
 	//每个客户端地址对应一个客户端实例
 	clients map[string]*client
+	//监控指标
+	metrics *metrics
+	//导出监控指标的http地址，为空时不启动
+	metricsAddr string
+	httpServer  *http.Server
+	//日志，默认不输出
+	logger Logger
+	//静态节点模式，不使用etcd注册和发现
+	static bool
+	//etcd注册中心的配置，没有设置discovery时使用
+	registry RegistryConfig
+	//服务发现，静态节点模式时为nil，ownDiscovery表示是自己创建的，Shutdown时关闭
+	discovery    Discovery
+	ownDiscovery bool
+	//停止监听注册中心的节点变化
+	watchCancel context.CancelFunc
+	//到其他节点的连接，ownConns表示是自己创建的，Shutdown时关闭
+	conns    *ConnManager
+	ownConns bool
+	//每个远程节点的熔断器配置
+	breakerConfig BreakerConfig
+	//请求其他节点时使用的gRPC压缩算法，为空时不压缩
+	rpcCompressor string
 }
 
 // NewServer 创建cache的serve 若addr为空 则使用defaultAddr
-func NewServer(addr string) (*server, error) {
+func NewServer(addr string, opts ...ServerOption) (*server, error) {
 	if addr == "" {
 		addr = defaultAddr
 	}
 	if !validPeerAddr(addr) {
 		return nil, fmt.Errorf("invalid addr %s, it should be x.x.x.x:port", addr)
 	}
-	return &server{addr: addr}, nil
+	s := &server{addr: addr, metrics: newMetrics(), logger: nopLogger{}}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.metrics.peerStats = s.PeerStats
+	if s.rpcCompressor != "" && encoding.GetCompressor(s.rpcCompressor) == nil {
+		return nil, fmt.Errorf("grpc compressor %s is not registered", s.rpcCompressor)
+	}
+	if s.static {
+		s.discovery = nil
+	} else if s.discovery == nil {
+		s.discovery = registry.SharedEtcd(s.registry)
+		s.ownDiscovery = true
+	}
+	if s.conns == nil {
+		s.conns = NewConnManager(s.discovery)
+		s.ownConns = true
+	}
+	return s, nil
+}
+
+// MetricsHandler 返回以Prometheus文本格式输出监控指标的handler
+// 可以挂到自己的http服务上，也可以用WithMetricsAddr让Start启动
+func (s *server) MetricsHandler() http.Handler {
+	return s.metrics
 }
 
 // Get 实现 GoCache service 的 Get 接口
@@ -62,106 +113,266 @@ func NewServer(addr string) (*server, error) {
 func (s *server) Get(ctx context.Context, req *pb.Request) (*pb.Response, error) {
 	// 请求中获取key和缓存池名
 	group, key := req.GetGroup(), req.GetKey()
+	s.logger.Debug("received Get request", "addr", s.addr, "group", group, "key", key)
+
+	value, err := s.getValue(ctx, group, key, req.GetLocalOnly())
+	if err != nil {
+		return nil, err
+	}
+	resp := &pb.Response{}
+	fillResponse(resp, value)
+	return resp, nil
+}
+
+// GetIfChanged 和Get一样，值的版本和调用方持有的一样时不返回值，只返回新的过期时间
+func (s *server) GetIfChanged(ctx context.Context, req *pb.ConditionalRequest) (*pb.Response, error) {
+	group, key := req.GetGroup(), req.GetKey()
+	s.logger.Debug("received GetIfChanged request", "addr", s.addr, "group", group, "key", key, "version", req.GetVersion())
+
+	value, err := s.getValue(ctx, group, key, false)
+	if err != nil {
+		return nil, err
+	}
 	resp := &pb.Response{}
+	fillResponse(resp, value)
+	if req.GetVersion() != 0 && resp.Version == req.GetVersion() {
+		resp.Value = nil
+		resp.NotModified = true
+	}
+	return resp, nil
+}
 
-	log.Printf("[geecache_svr %s] Received RPC Request - Group: %s, Key: %s", s.addr, group, key)
+// getValue 查找缓存组并获取值，错误已经转换成gRPC状态码
+func (s *server) getValue(ctx context.Context, group, key string, localOnly bool) (ByteView, error) {
 	if key == "" {
-		return resp, fmt.Errorf("key is required")
+		return ByteView{}, status.Error(codes.InvalidArgument, "key is required")
 	}
 
 	// 获取缓存池名对应得缓存组，例如score
 	g := GetGroup(group)
 	if g == nil {
-		return resp, fmt.Errorf("group %s not found", group)
+		return ByteView{}, status.Errorf(codes.FailedPrecondition, "group %s not found", group)
+	}
+
+	// 对冲请求由自己加载，不再转发给负责的节点
+	if localOnly {
+		value, err := g.getFromLocal(ctx, key)
+		if err != nil {
+			return ByteView{}, loadStatus(key, err)
+		}
+		return value, nil
 	}
 
 	// 尝试从缓存获取数据，组里本地或者远程调用，客户端调用另一个节点得这个服务端
-	value, err := g.Get(key)
+	// 使用请求的ctx，客户端取消或超时时停止加载
+	value, err := g.GetContext(ctx, key)
 
 	if err == nil {
-		resp.Value = value.ByteSlice()
-		return resp, nil
+		return value, nil
+	}
+	// key不存在或者客户端已经放弃，不再从数据库加载
+	if errors.Is(err, ErrNotFound) || ctx.Err() != nil {
+		return ByteView{}, loadStatus(key, err)
 	}
 
 	// 数据不在缓存中，从数据库加载
-	view, err := g.getLocally(key)
+	view, err := g.getLocally(ctx, key)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load data for key %s: %v", key, err)
+		return ByteView{}, loadStatus(key, err)
+	}
+	return view, nil
+}
+
+// loadStatus 把加载错误转换成gRPC状态码，客户端据此判断是否重试、回退
+func loadStatus(key string, err error) error {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return status.Errorf(codes.NotFound, "failed to load data for key %s: %v", key, err)
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	default:
+		return status.Errorf(codes.Unknown, "failed to load data for key %s: %v", key, err)
+	}
+}
+
+// Set 实现 GoCache service 的 Set 接口，写入负责这个key的节点
+func (s *server) Set(ctx context.Context, req *pb.SetRequest) (*pb.SetResponse, error) {
+	group, key := req.GetGroup(), req.GetKey()
+	s.logger.Debug("received Set request", "addr", s.addr, "group", group, "key", key)
+
+	g := GetGroup(group)
+	if g == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "group %s not found", group)
 	}
+	ttl := time.Duration(req.GetTtl()) * time.Millisecond
+	if err := g.SetContext(ctx, key, req.GetValue(), ttl); err != nil {
+		return nil, err
+	}
+	return &pb.SetResponse{}, nil
+}
+
+// Delete 实现 GoCache service 的 Delete 接口
+// local_only 为true时是负责节点发来的清除副本请求，只删除本地的副本
+func (s *server) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+	group, key := req.GetGroup(), req.GetKey()
+	s.logger.Debug("received Delete request", "addr", s.addr, "group", group, "key", key)
 
-	resp.Value = view.ByteSlice()
+	g := GetGroup(group)
+	if g == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "group %s not found", group)
+	}
+	if req.GetLocalOnly() {
+		// 可能是Set之后的清除，key已经存在，加入过滤器；Remove之后多加一个key也不会误拦截
+		g.addKey(key)
+		g.removeLocally(key)
+		return &pb.DeleteResponse{}, nil
+	}
+	if err := g.RemoveContext(ctx, key); err != nil {
+		return nil, err
+	}
+	return &pb.DeleteResponse{}, nil
+}
+
+// BatchGet 实现 GoCache service 的 BatchGet 接口，一次返回多个key
+func (s *server) BatchGet(ctx context.Context, req *pb.BatchRequest) (*pb.BatchResponse, error) {
+	group, keys := req.GetGroup(), req.GetKeys()
+	s.logger.Debug("received BatchGet request", "addr", s.addr, "group", group, "keys", len(keys))
+
+	g := GetGroup(group)
+	if g == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "group %s not found", group)
+	}
+	values, errs := g.GetMany(ctx, keys)
+	resp := &pb.BatchResponse{
+		Values:   make(map[string][]byte, len(values)),
+		Errors:   make(map[string]string, len(errs)),
+		Expires:  make(map[string]int64, len(values)),
+		Versions: make(map[string]uint64, len(values)),
+	}
+	for key, value := range values {
+		resp.Values[key] = value.ByteSlice()
+		resp.Expires[key] = expireToMillis(value.expire)
+		resp.Versions[key] = value.Version()
+	}
+	for key, err := range errs {
+		resp.Errors[key] = err.Error()
+		if errors.Is(err, ErrNotFound) {
+			resp.NotFound = append(resp.NotFound, key)
+		}
+	}
 	return resp, nil
 }
 
 // Start 启动cache服务，对于结构体初始化
 // -----------------启动服务----------------------
 //  1. 设置status为true 表示服务器已在运行
-//  2. 初始化stop channal,这用于通知registry stop keep alive
-//  3. 初始化tcp socket并开始监听
-//  4. 注册rpc服务至grpc 这样grpc收到request可以分发给server处理
-//  5. 将自己的服务名/Host地址注册至etcd 这样client可以通过etcd
+//  2. 初始化tcp socket并开始监听
+//  3. 注册rpc服务至grpc 这样grpc收到request可以分发给server处理
+//  4. 将自己的服务名/Host地址注册至服务发现(默认etcd) 这样client可以通过etcd
 //     获取服务Host地址 从而进行通信。这样的好处是client只需知道服务名
 //     以及etcd的Host即可获取对应服务IP 无需写死至client代码中
+//  5. 监听服务发现中的所有节点，节点加入或离开时更新哈希环
 //
 // ----------------------------------------------
+// Start 会一直阻塞，直到Shutdown或Stop，监听或注册失败时返回错误
 func (s *server) Start() error {
 	s.mu.Lock()
-	if s.status == true {
+	if s.status || s.starting != nil {
 		s.mu.Unlock()
 		return fmt.Errorf("server already started")
 	}
+	started := make(chan struct{})
+	s.starting = started
+	s.mu.Unlock()
 
-	s.status = true
-	// 创建一个接收停止信号的通道，这个通道用于从注册服务接收停止或错误信号
-	s.stopSignal = make(chan error)
-	// 启动TCP服务器，监听指定端口
-	port := strings.Split(s.addr, ":")[1]
-	lis, err := net.Listen("tcp", ":"+port)
+	// 监听和注册可能要等待网络，不持有锁，Pick等方法不会被阻塞
+	lis, err := s.listenAndRegister()
+	s.mu.Lock()
+	s.starting = nil
 	if err != nil {
-		return fmt.Errorf("failed to listen: %v", err)
+		s.mu.Unlock()
+		close(started)
+		return err
 	}
 
-	// 创建新的服务器实例
-	grpcServer := grpc.NewServer()
+	// 创建新的服务器实例，拦截器记录每个请求的耗时
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(s.metrics.unaryInterceptor))
 	// 这个服务器实例与 gRPC 服务相关联，允许 gRPC 处理到来的请求。
 	// 客户端对sever得get请求，gRPC服务器知道调用s中得get方法
 	pb.RegisterGroupCacheServer(grpcServer, s)
 
-	// 注册服务至etcd，异步运行服务注册逻辑，避免阻塞主线程
-	go func() {
-		//注册服务器的地址到etcd，这样客户端可以通过 etcd 发现并连接到这个服务器。
-		err := registry.Register("geecache", s.addr, s.stopSignal)
-		if err != nil {
-			log.Fatalf(err.Error())
-		}
-		// 注册失败关闭通道，返回了错误信号，主协程就知道了
-		close(s.stopSignal)
+	// 监听服务发现，节点加入或离开时更新哈希环
+	if s.discovery != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.watchCancel = cancel
+		go s.watchPeers(ctx)
+	}
 
-		err = lis.Close()
-		if err != nil {
-			log.Fatalf(err.Error())
-		}
-		log.Printf("[%s] Revoke service and close tcp socket ok.", s.addr)
-	}()
+	// 启动监控指标的http服务
+	if s.metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", s.metrics)
+		s.httpServer = &http.Server{Addr: s.metricsAddr, Handler: mux}
+		go func(hs *http.Server) {
+			if err := hs.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				s.logger.Error("metrics server failed", "addr", s.addr, "err", err)
+			}
+		}(s.httpServer)
+	}
 
-	//log.Printf("[%s] register service ok\n", s.addr)
+	s.status = true
+	s.grpcServer = grpcServer
 	s.mu.Unlock()
+	close(started)
 
 	// 在之前创建的监听器上服务gRPC请求，这是一个阻塞调用，会持续监听直到服务器关闭
-	if err := grpcServer.Serve(lis); s.status && err != nil {
+	// Shutdown或Stop之后Serve返回nil，在Serve之前就关闭了返回ErrServerStopped
+	if err := grpcServer.Serve(lis); err != nil && err != grpc.ErrServerStopped {
 		return fmt.Errorf("failed to serve: %v", err)
 	}
 	return nil
 }
 
+// listenAndRegister 监听端口并把自己注册到服务发现，静态节点模式不注册
+func (s *server) listenAndRegister() (net.Listener, error) {
+	// 启动TCP服务器，监听指定端口
+	port := strings.Split(s.addr, ":")[1]
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %v", err)
+	}
+
+	//注册服务器的地址，这样客户端可以通过服务发现连接到这个服务器
+	if s.discovery != nil {
+		if err := s.discovery.Register(context.Background(), s.addr); err != nil {
+			lis.Close()
+			return nil, fmt.Errorf("failed to register %s: %v", s.addr, err)
+		}
+		s.logger.Info("registered service", "addr", s.addr)
+	}
+	return lis, nil
+}
+
 // SetPeers 将各个远端主机IP添加到Server里
 // 这样Server就可以Pick他们了
 // 注意: 此操作是*覆写*操作！
 // 注意: peersIP必须满足 x.x.x.x:port的格式
+// 注意: 使用etcd时，Start之后节点列表由注册中心维护，会覆盖这里设置的节点
 func (s *server) SetPeers(peersAddr ...string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	// 关闭不再使用的节点的连接
+	want := make(map[string]bool, len(peersAddr))
+	for _, peerAddr := range peersAddr {
+		want[peerAddr] = true
+	}
+	for peerAddr := range s.clients {
+		if !want[peerAddr] {
+			s.closeConn(peerAddr)
+		}
+	}
+
 	//初始化一个一致性哈希环
 	s.consHash = consistenthash.New(defaultReplicas, nil)
 	//供的远程节点地址注册到一致性哈希环中
@@ -173,11 +384,92 @@ func (s *server) SetPeers(peersAddr ...string) {
 			panic(fmt.Sprintf("[peer %s] invalid address format, it should be x.x.x.x:port", peerAddr))
 		}
 		//对于每一个有效的节点地址，创建并注册新的客户端实例
-		service := fmt.Sprintf("gocache/%s", peerAddr)
-		//fmt.Sprintln("service is", service)
-		s.clients[peerAddr] = NewClient(service)
-		// peerAddr -> gocache/peerAddr
-		//registry.Register(service,peerAddr,make(chan error, 1))
+		s.clients[peerAddr] = s.newClient(peerAddr)
+	}
+}
+
+// 为远程节点创建客户端，peerAddr -> geecache/peerAddr
+// 所有客户端共用server的连接管理器
+func (s *server) newClient(peerAddr string) *client {
+	return &client{
+		name:     s.registry.ServiceName(peerAddr),
+		addr:     peerAddr,
+		metrics:  s.metrics,
+		logger:   s.logger,
+		conns:    s.conns,
+		breaker:  newBreaker(s.breakerConfig),
+		callOpts: s.callOptions(),
+	}
+}
+
+// callOptions client每次调用附带的gRPC选项
+func (s *server) callOptions() []grpc.CallOption {
+	if s.rpcCompressor == "" {
+		return nil
+	}
+	return []grpc.CallOption{grpc.UseCompressor(s.rpcCompressor)}
+}
+
+// closeConn 节点离开哈希环时关闭到它的连接
+// WithConnManager共用的连接可能还有其他server在用，不关闭，由创建者管理
+func (s *server) closeConn(peerAddr string) {
+	if !s.ownConns {
+		return
+	}
+	if err := s.conns.Remove(peerAddr); err != nil {
+		s.logger.Warn("close peer connection failed", "addr", s.addr, "peer", peerAddr, "err", err)
+	}
+}
+
+// updatePeers 按最新的节点列表增删哈希环上的节点和客户端
+// 和SetPeers不同，没有变化的节点保留原来的客户端
+func (s *server) updatePeers(peersAddr []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.consHash == nil {
+		s.consHash = consistenthash.New(defaultReplicas, nil)
+		s.clients = make(map[string]*client)
+	}
+	want := make(map[string]bool, len(peersAddr))
+	for _, peerAddr := range peersAddr {
+		want[peerAddr] = true
+	}
+	for peerAddr := range s.clients {
+		if !want[peerAddr] {
+			s.consHash.Remove(peerAddr)
+			delete(s.clients, peerAddr)
+			s.closeConn(peerAddr)
+			s.logger.Info("peer left", "addr", s.addr, "peer", peerAddr)
+		}
+	}
+	for _, peerAddr := range peersAddr {
+		if _, ok := s.clients[peerAddr]; ok {
+			continue
+		}
+		if !validPeerAddr(peerAddr) {
+			s.logger.Warn("ignore peer with invalid address", "addr", s.addr, "peer", peerAddr)
+			continue
+		}
+		s.consHash.Add(peerAddr)
+		s.clients[peerAddr] = s.newClient(peerAddr)
+		s.logger.Info("peer joined", "addr", s.addr, "peer", peerAddr)
+	}
+}
+
+// watchPeers 监听服务发现的节点变化，监听中断时等一会儿重新监听，直到ctx结束
+func (s *server) watchPeers(ctx context.Context) {
+	for {
+		err := s.discovery.Watch(ctx, s.updatePeers)
+		if ctx.Err() != nil {
+			return
+		}
+		s.logger.Warn("watch peers failed, retrying", "addr", s.addr, "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
 	}
 }
 
@@ -188,30 +480,183 @@ func (s *server) Pick(key string) (Fetcher, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	c, ok := s.owner(key)
+	if !ok {
+		return nil, false
+	}
+	// 熔断器打开时从本地获取
+	if !c.breaker.ready() {
+		s.logger.Debug("peer circuit breaker is open, pick myself", "addr", s.addr, "key", key, "peer", c.addr)
+		return nil, false
+	}
+	s.logger.Debug("pick remote peer", "addr", s.addr, "key", key, "peer", c.addr)
+	// 返回远程节点
+	return c, true
+}
+
+// Owner 返回负责key的远程节点，熔断器打开时也返回它，自己负责时返回false
+// 写入和删除必须交给真正负责的节点，不能因为熔断写到自己这里
+func (s *server) Owner(key string) (Fetcher, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.owner(key)
+	if !ok {
+		return nil, false
+	}
+	return c, true
+}
+
+// owner 调用时已经持有锁，按哈希环找到负责key的远程节点
+func (s *server) owner(key string) (*client, bool) {
+	// 还没有节点，从本地获取
+	if s.consHash == nil {
+		return nil, false
+	}
 	//返回节点地址
 	peerAddr := s.consHash.Get(key)
+	if peerAddr == "" {
+		return nil, false
+	}
 	// Pick itself
 	if peerAddr == s.addr {
-		log.Printf("ooh! pick myself, I am %s\n", s.addr)
+		s.logger.Debug("pick myself", "addr", s.addr, "key", key)
 		return nil, false
 	}
-	log.Printf("[cache %s] pick remote peer: %s\n", s.addr, peerAddr)
-	// 返回远程节点
-	return s.clients[peerAddr], true
+	c, ok := s.clients[peerAddr]
+	return c, ok
+}
+
+// Successor 返回key在哈希环上的下一个节点，用于对冲请求
+// 下一个节点是自己、熔断器打开或者没有其他节点时返回false
+func (s *server) Successor(key string) (Fetcher, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
+	if s.consHash == nil {
+		return nil, false
+	}
+	nodes := s.consHash.GetN(key, 2)
+	if len(nodes) < 2 || nodes[1] == s.addr {
+		return nil, false
+	}
+	c := s.clients[nodes[1]]
+	if !c.breaker.ready() {
+		return nil, false
+	}
+	return c, true
 }
 
-// Stop 停止server运行 如果server没有运行 这将是一个no-op
-func (s *server) Stop() {
+// PeerStats 返回所有远程节点的状态，按地址排序
+func (s *server) PeerStats() []PeerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := make([]PeerStats, 0, len(s.clients))
+	for addr, c := range s.clients {
+		if addr == s.addr {
+			continue
+		}
+		state, failures, opens := c.breaker.stats()
+		stats = append(stats, PeerStats{Addr: addr, Breaker: state, Failures: failures, Opens: opens})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Addr < stats[j].Addr })
+	return stats
+}
+
+// Peers 返回除自己以外的所有远程节点
+func (s *server) Peers() []Fetcher {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := make([]Fetcher, 0, len(s.clients))
+	for addr, c := range s.clients {
+		if addr != s.addr {
+			peers = append(peers, c)
+		}
+	}
+	return peers
+}
+
+// Shutdown 优雅地停止server，如果server没有运行 这将是一个no-op
+//  1. 停止监听节点变化，从服务发现注销自己，其他节点不再把请求发过来
+//  2. 等待正在处理的请求完成(GracefulStop)，ctx结束时强制停止
+//  3. 关闭监控指标的http服务，以及自己创建的到其他节点的连接和服务发现的客户端
+//
+// # Start还在监听和注册时，等它完成后再停止
+//
+// 出错时继续后面的步骤，返回所有的错误
+func (s *server) Shutdown(ctx context.Context) error {
 	s.mu.Lock()
+	// Start还在监听和注册，等它完成再停止，否则Start之后会一直运行
+	if started := s.starting; started != nil {
+		s.mu.Unlock()
+		select {
+		case <-started:
+		case <-ctx.Done():
+			return fmt.Errorf("wait for start: %v", ctx.Err())
+		}
+		s.mu.Lock()
+	}
 	if s.status == false {
 		s.mu.Unlock()
-		return
+		return nil
 	}
-
-	s.stopSignal <- nil // 发送停止keepalive信号
-	s.status = false    // 设置server运行状态为stop
-	s.clients = nil     // 清空一致性哈希信息 有助于垃圾回收
-	s.consHash = nil
+	s.status = false // 设置server运行状态为stop
+	if s.watchCancel != nil {
+		s.watchCancel() // 停止监听节点变化
+		s.watchCancel = nil
+	}
+	grpcServer, httpServer := s.grpcServer, s.httpServer
+	s.grpcServer, s.httpServer = nil, nil
 	s.mu.Unlock()
+
+	var errs []error
+	if s.discovery != nil {
+		if err := s.discovery.Deregister(ctx, s.addr); err != nil {
+			errs = append(errs, fmt.Errorf("deregister %s: %v", s.addr, err))
+		}
+	}
+
+	// 等待正在处理的请求完成
+	drained := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		grpcServer.Stop()
+		<-drained
+		errs = append(errs, fmt.Errorf("drain requests: %v", ctx.Err()))
+	}
+
+	if httpServer != nil {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("shutdown metrics server: %v", err))
+		}
+	}
+
+	// 请求都处理完了，再关闭到其他节点的连接，共用的连接管理器由创建者关闭
+	if s.ownConns {
+		if err := s.conns.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// WithDiscovery传入的服务发现由调用方关闭
+	if closer, ok := s.discovery.(io.Closer); ok && s.ownDiscovery {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close discovery: %v", err))
+		}
+	}
+	s.logger.Info("server stopped", "addr", s.addr)
+	return errors.Join(errs...)
+}
+
+// Stop 停止server运行，等待正在处理的请求完成，如果server没有运行 这将是一个no-op
+// 需要超时或者关心错误时使用Shutdown
+func (s *server) Stop() {
+	if err := s.Shutdown(context.Background()); err != nil {
+		s.logger.Error("stop server failed", "addr", s.addr, "err", err)
+	}
 }
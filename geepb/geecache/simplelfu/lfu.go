@@ -66,7 +66,6 @@ func (c *LFU) PurgeOverdue() {
 			c.removeElement(ent)
 		}
 	}
-	c.evictList.Init()
 }
 
 // Add adds a value to the cache.  Returns true if an eviction occurred.
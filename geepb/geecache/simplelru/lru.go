@@ -64,7 +64,6 @@ func (c *LRU) PurgeOverdue() {
 			c.removeElement(ent)
 		}
 	}
-	c.evictList.Init()
 }
 
 // Add adds a value to the cache.  Returns true if an eviction occurred.
@@ -1,52 +1,76 @@
 package singleflight
 
-import "sync"
+import (
+	"context"
+	"errors"
+	"sync"
+)
 
-//正在进行或者结束的请求，
+// 正在进行或者结束的请求，
 type call struct {
-	//避免重复
-	wg sync.WaitGroup
+	//请求结束时关闭，等待的协程可以同时监听自己的ctx
+	done chan struct{}
 	//空接口，可以接收任意类型的值
 	val interface{}
 	err error
 }
 
-//管理不同的call请求
+// 管理不同的call请求
 type Group struct {
 	//保护m的锁
 	mu sync.Mutex
 	m  map[string]*call
 }
 
-//针对相同的 key，无论 Do 被调用多少次，函数 fn 都只会被调用一次，对于多个协程，也是返回了多次值
+// 针对相同的 key，无论 Do 被调用多少次，函数 fn 都只会被调用一次，对于多个协程，也是返回了多次值
 func (g *Group) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
-	g.mu.Lock()
-	if g.m == nil {
-		//新建map
-		g.m = make(map[string]*call)
-	}
-	//如果重复请求,阻塞当前协程
-	if c, ok := g.m[key]; ok {
+	return g.DoContext(context.Background(), key, func(context.Context) (interface{}, error) {
+		return fn()
+	})
+}
+
+// DoContext 和Do一样，但等待的协程在自己的ctx结束时直接返回ctx.Err()
+// fn 使用第一个调用者的ctx执行，如果它因为第一个调用者取消而失败，
+// 还没取消的等待者会重新发起一次请求
+func (g *Group) DoContext(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	for {
+		g.mu.Lock()
+		if g.m == nil {
+			//新建map
+			g.m = make(map[string]*call)
+		}
+		//如果重复请求,阻塞当前协程
+		if c, ok := g.m[key]; ok {
+			g.mu.Unlock()
+			select {
+			case <-c.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			// 第一个调用者被取消了，自己还没有，重新请求
+			if isContextErr(c.err) && ctx.Err() == nil {
+				continue
+			}
+			//处理完了直接返回，对于call类型没有上锁，任意协程可以获得值返回
+			return c.val, c.err
+		}
+		//不是重复请求，建立一个新请求对象
+		c := &call{done: make(chan struct{})}
+		g.m[key] = c
 		g.mu.Unlock()
-		//延迟处理，提供效率
-		c.wg.Wait()
-		//处理完了直接返回，对于call类型没有上锁，任意协程可以获得值返回
+
+		c.val, c.err = fn(ctx)
+		//一个请求结束
+		close(c.done)
+
+		g.mu.Lock()
+		delete(g.m, key)
+		g.mu.Unlock()
+
 		return c.val, c.err
 	}
-	//不是重复请求，建立一个新请求对象
-	c := new(call)
-	//请求前加锁，有一个新任务执行
-	c.wg.Add(1)
-	g.m[key] = c
-	g.mu.Unlock()
-
-	c.val, c.err = fn()
-	//一个请求结束
-	c.wg.Done()
-
-	g.mu.Lock()
-	delete(g.m, key)
-	g.mu.Unlock()
-
-	return c.val, c.err
+}
+
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
 }
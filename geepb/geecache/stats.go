@@ -0,0 +1,82 @@
+package geecache
+
+import "sync/atomic"
+
+// Stats 缓存池的统计信息
+type Stats struct {
+	Gets            int64 // Get的次数，批量获取时每个key算一次
+	Hits            int64 // 主缓存或热点缓存命中的次数
+	Misses          int64 // 两个缓存都没有命中的次数
+	NegativeHits    int64 // 负缓存命中，直接返回错误的次数
+	BloomRejects    int64 // 被布隆过滤器拦截的次数
+	Loads           int64 // 没有命中后加载的次数
+	LoadsDeduped    int64 // 经过singleflight去重后真正加载的次数
+	PeerLoads       int64 // 从远程节点获取成功的次数
+	PeerErrors      int64 // 从远程节点获取失败的次数
+	PeerRetries     int64 // 重试远程节点的次数
+	PeerHedges      int64 // 向下一个节点发对冲请求的次数
+	PeerNotModified int64 // 按版本获取时值没有变化，不用再传输的次数
+	LocalLoads      int64 // 从Getter加载成功的次数
+	LocalLoadErrs   int64 // 从Getter加载失败的次数
+	Refreshes       int64 // 条目快过期时在后台刷新的次数
+	StaleHits       int64 // 加载失败时返回过期旧值的次数
+	Evictions       int64 // 主缓存淘汰的条数
+}
+
+// groupStats 缓存池运行时的计数器，并发更新
+type groupStats struct {
+	gets            atomic.Int64
+	hits            atomic.Int64
+	misses          atomic.Int64
+	negativeHits    atomic.Int64
+	bloomRejects    atomic.Int64
+	loads           atomic.Int64
+	loadsDeduped    atomic.Int64
+	peerLoads       atomic.Int64
+	peerErrors      atomic.Int64
+	peerRetries     atomic.Int64
+	peerHedges      atomic.Int64
+	peerNotModified atomic.Int64
+	localLoads      atomic.Int64
+	localLoadErrs   atomic.Int64
+	refreshes       atomic.Int64
+	staleHits       atomic.Int64
+}
+
+// Stats 返回缓存池统计信息的快照
+func (g *Group) Stats() Stats {
+	return Stats{
+		Gets:            g.stats.gets.Load(),
+		Hits:            g.stats.hits.Load(),
+		Misses:          g.stats.misses.Load(),
+		NegativeHits:    g.stats.negativeHits.Load(),
+		BloomRejects:    g.stats.bloomRejects.Load(),
+		Loads:           g.stats.loads.Load(),
+		LoadsDeduped:    g.stats.loadsDeduped.Load(),
+		PeerLoads:       g.stats.peerLoads.Load(),
+		PeerErrors:      g.stats.peerErrors.Load(),
+		PeerRetries:     g.stats.peerRetries.Load(),
+		PeerHedges:      g.stats.peerHedges.Load(),
+		PeerNotModified: g.stats.peerNotModified.Load(),
+		LocalLoads:      g.stats.localLoads.Load(),
+		LocalLoadErrs:   g.stats.localLoadErrs.Load(),
+		Refreshes:       g.stats.refreshes.Load(),
+		StaleHits:       g.stats.staleHits.Load(),
+		Evictions:       g.mainCache.stats().Evictions,
+	}
+}
+
+// CacheStats 主缓存的统计信息
+func (g *Group) CacheStats() CacheStats {
+	return g.mainCache.stats()
+}
+
+// HotCacheStats 热点缓存的统计信息
+func (g *Group) HotCacheStats() CacheStats {
+	return g.hotCache.stats()
+}
+
+// NegativeCacheStats 负缓存的统计信息
+func (g *Group) NegativeCacheStats() CacheStats {
+	return g.negCache.stats()
+}
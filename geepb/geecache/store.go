@@ -0,0 +1,227 @@
+package geecache
+
+import (
+	"geecache/arc"
+	"geecache/highperformance"
+	"geecache/lru"
+	"geecache/simplelfu"
+	"geecache/simplelru"
+	"math"
+	"time"
+)
+
+// Store 主缓存的存储接口，不同的淘汰策略实现这个接口
+// cache 调用时已经加锁，Store 的实现不需要是线程安全的
+type Store interface {
+	// Add 添加或更新一个值，expire为0表示不过期
+	Add(key string, value ByteView, expire time.Duration)
+	// Get 查找一个值，过期的值视为不存在
+	Get(key string) (value ByteView, ok bool)
+	// Remove 删除一个值，返回是否存在
+	Remove(key string) bool
+	// Len 缓存的条数
+	Len() int
+	// Bytes 缓存占用的字节数(key+value)
+	Bytes() int64
+}
+
+// OverdueStore 可选接口，清除所有过期的条目
+// 过期的条目只在Get时删除，缓存没有满时会一直占用内存，cache定期调用它清理，内置的Store都实现了它
+type OverdueStore interface {
+	PurgeOverdue()
+}
+
+// ExpireStore 可选接口，查找时同时返回过期的时间点，不过期时为零值
+// 刷新和过期后继续使用旧值需要知道条目什么时候过期，内置的Store都实现了它
+type ExpireStore interface {
+	GetWithExpire(key string) (value ByteView, expire time.Time, ok bool)
+}
+
+// Policy 淘汰策略，根据缓存池大小创建一个Store
+// onEvicted 在条目离开缓存时回调，可以为nil
+type Policy interface {
+	NewStore(cacheBytes int64, onEvicted func(key string, value ByteView)) Store
+}
+
+// PolicyFunc 接口型函数，和GetterFunc一样，普通函数也可以作为Policy
+type PolicyFunc func(cacheBytes int64, onEvicted func(key string, value ByteView)) Store
+
+func (f PolicyFunc) NewStore(cacheBytes int64, onEvicted func(key string, value ByteView)) Store {
+	return f(cacheBytes, onEvicted)
+}
+
+// 内置的淘汰策略
+var (
+	// LRU 默认策略，按字节数淘汰最久未使用的条目
+	LRU Policy = PolicyFunc(newLruStore)
+	// LFU 淘汰访问次数最少的条目
+	LFU Policy = PolicyFunc(func(cacheBytes int64, onEvicted func(string, ByteView)) Store {
+		return newEntryStore(cacheBytes, onEvicted, func(size int, onEvict simplelru.EvictCallback) (entryCache, error) {
+			return simplelfu.NewLFU(size, simplelfu.EvictCallback(onEvict))
+		})
+	})
+	// HashLRU 按key分片的LRU
+	HashLRU Policy = PolicyFunc(func(cacheBytes int64, onEvicted func(string, ByteView)) Store {
+		return newEntryStore(cacheBytes, onEvicted, func(size int, onEvict simplelru.EvictCallback) (entryCache, error) {
+			// 每个分片的条数上限都是size，只按字节数淘汰，落在同一个分片的key不会在还有空间时互相淘汰
+			if size > math.MaxInt/hashLruShards {
+				size = math.MaxInt / hashLruShards
+			}
+			return highperformance.NewHashLruWithEvict(size*hashLruShards, hashLruShards, onEvict)
+		})
+	})
+	// ARC 自适应替换，突发的一次性访问不会冲掉热点key
+	ARC Policy = PolicyFunc(func(cacheBytes int64, onEvicted func(string, ByteView)) Store {
+		return newEntryStore(cacheBytes, onEvicted, func(size int, onEvict simplelru.EvictCallback) (entryCache, error) {
+			return arc.NewARCWithEvict(size, onEvict)
+		})
+	})
+)
+
+// HashLRU的分片数，固定下来，淘汰行为不随CPU数变化
+const hashLruShards = 16
+
+// lruStore 用lru.Lru实现Store
+type lruStore struct {
+	*lru.Lru
+}
+
+func newLruStore(cacheBytes int64, onEvicted func(key string, value ByteView)) Store {
+	var cb func(string, lru.Value)
+	if onEvicted != nil {
+		cb = func(key string, value lru.Value) {
+			onEvicted(key, value.(ByteView))
+		}
+	}
+	l := lru.New(cacheBytes, cb)
+	// lru的定时清理协程不加锁，会和cache并发访问，这里关掉
+	// 改由cache加锁后定期调用PurgeOverdue清理
+	l.Stop()
+	return &lruStore{l}
+}
+
+func (s *lruStore) Add(key string, value ByteView, expire time.Duration) {
+	s.Lru.Add(key, value, expire)
+}
+
+func (s *lruStore) Get(key string) (value ByteView, ok bool) {
+	value, _, ok = s.GetWithExpire(key)
+	return
+}
+
+func (s *lruStore) GetWithExpire(key string) (value ByteView, expire time.Time, ok bool) {
+	v, expire, ok := s.Lru.GetWithExpire(key)
+	if !ok {
+		return
+	}
+	return v.(ByteView), expire, true
+}
+
+// entryCache simplelru、simplelfu、HashLRU和ARC共有的方法
+type entryCache interface {
+	Add(key, value interface{}, expirationTime int64) (ok bool)
+	Get(key interface{}) (value interface{}, expirationTime int64, ok bool)
+	Peek(key interface{}) (value interface{}, expirationTime int64, ok bool)
+	Remove(key interface{}) (ok bool)
+	RemoveOldest() (key interface{}, value interface{}, expirationTime int64, ok bool)
+	PurgeOverdue()
+	Len() int
+}
+
+// entryStore 把按条数淘汰的缓存包装成按字节数淘汰的Store
+// 这些缓存在条目离开时都会回调，字节数在回调里扣除
+type entryStore struct {
+	c         entryCache
+	maxBytes  int64
+	nbytes    int64
+	onEvicted func(key string, value ByteView)
+}
+
+func newEntryStore(cacheBytes int64, onEvicted func(string, ByteView),
+	newCache func(size int, onEvict simplelru.EvictCallback) (entryCache, error)) Store {
+	s := &entryStore{maxBytes: cacheBytes, onEvicted: onEvicted}
+	// 条数上限：每个条目至少占一个字节，cacheBytes为0表示不限制
+	size := math.MaxInt32
+	if cacheBytes > 0 && cacheBytes < math.MaxInt32 {
+		size = int(cacheBytes)
+	}
+	c, err := newCache(size, s.evicted)
+	if err != nil {
+		panic(err)
+	}
+	s.c = c
+	return s
+}
+
+func (s *entryStore) evicted(key, value interface{}, expirationTime int64) {
+	k, v := key.(string), value.(ByteView)
+	s.nbytes -= int64(len(k)) + int64(v.Len())
+	if s.onEvicted != nil {
+		s.onEvicted(k, v)
+	}
+}
+
+func (s *entryStore) Add(key string, value ByteView, expire time.Duration) {
+	size := int64(len(key)) + int64(value.Len())
+	// 更新已有的key时不会回调，要扣掉旧值的大小
+	need := size
+	if old, _, ok := s.c.Peek(key); ok && old != nil {
+		need -= int64(len(key)) + int64(old.(ByteView).Len())
+	}
+	// 先腾出空间再添加，LFU的新条目排在最后，后淘汰会把刚加入的条目淘汰掉
+	for s.maxBytes != 0 && s.nbytes+need > s.maxBytes && s.c.Len() > 0 {
+		k, _, _, ok := s.c.RemoveOldest()
+		if !ok {
+			break
+		}
+		if k == key {
+			// 旧值已经在回调里扣除了
+			need = size
+		}
+	}
+	var expirationTime int64
+	if expire > 0 {
+		expirationTime = time.Now().Add(expire).UnixNano() / 1e6
+	}
+	s.c.Add(key, value, expirationTime)
+	s.nbytes += need
+	// 单个条目就超过了缓存大小
+	for s.maxBytes != 0 && s.maxBytes < s.nbytes {
+		if _, _, _, ok := s.c.RemoveOldest(); !ok {
+			break
+		}
+	}
+}
+
+func (s *entryStore) Get(key string) (value ByteView, ok bool) {
+	value, _, ok = s.GetWithExpire(key)
+	return
+}
+
+// GetWithExpire 这些缓存的过期时间是毫秒时间戳，0表示不过期
+func (s *entryStore) GetWithExpire(key string) (value ByteView, expire time.Time, ok bool) {
+	v, expirationTime, ok := s.c.Get(key)
+	if !ok || v == nil {
+		return ByteView{}, time.Time{}, false
+	}
+	if expirationTime > 0 {
+		expire = time.UnixMilli(expirationTime)
+	}
+	return v.(ByteView), expire, true
+}
+
+func (s *entryStore) PurgeOverdue() {
+	s.c.PurgeOverdue()
+}
+
+func (s *entryStore) Remove(key string) bool {
+	return s.c.Remove(key)
+}
+
+func (s *entryStore) Len() int {
+	return s.c.Len()
+}
+
+func (s *entryStore) Bytes() int64 {
+	return s.nbytes
+}
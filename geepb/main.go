@@ -31,14 +31,18 @@ func main() {
 		// 三个真实节点
 		svr.SetPeers(addrs...)
 		// 多个缓存池节点，有各自的rpc服务
-		group := geecache.NewGroup(groupname[i], 2<<10, time.Second, geecache.GetterFunc(
+		// 不存在的key放到负缓存，短时间内不再查数据库
+		group := geecache.NewGroupWithOptions(groupname[i], geecache.GetterFunc(
 			func(key string) ([]byte, error) {
 				log.Println("[Mysql] search key", key)
 				if v, ok := db[key]; ok {
 					return []byte(v), nil
 				}
-				return nil, fmt.Errorf("%s not exist", key)
-			}))
+				return nil, fmt.Errorf("%s not exist: %w", key, geecache.ErrNotFound)
+			}),
+			geecache.WithCacheBytes(2<<10),
+			geecache.WithExpire(time.Second),
+			geecache.WithNegativeCache(1<<10, 5*time.Second))
 		// 启动服务
 		go func() {
 			err := svr.Start()